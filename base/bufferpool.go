@@ -0,0 +1,38 @@
+package base
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// 按容量分级的字节缓冲池, 每一级的容量为 2 的幂
+var bufferPools [48]sync.Pool
+
+// GetBuffer 从缓冲池获取长度为 size 的缓冲区, 内容未清零
+func GetBuffer(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	class := bits.Len(uint(size - 1))
+	if class >= len(bufferPools) {
+		return make([]byte, size)
+	}
+	if pooled := bufferPools[class].Get(); pooled != nil {
+		return (*pooled.(*[]byte))[:size]
+	}
+	return make([]byte, size, 1<<class)
+}
+
+// PutBuffer 将 GetBuffer 获取的缓冲区归还缓冲池, 归还后不可再使用
+func PutBuffer(buffer []byte) {
+	capacity := cap(buffer)
+	if capacity == 0 || capacity&(capacity-1) != 0 {
+		return
+	}
+	class := bits.Len(uint(capacity - 1))
+	if class >= len(bufferPools) {
+		return
+	}
+	buffer = buffer[:capacity]
+	bufferPools[class].Put(&buffer)
+}
@@ -0,0 +1,125 @@
+package base
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// ChunkCache 按 URL 与偏移量缓存已下载的分块数据, 由所有会话共享
+// 同一分块同时只会向源站请求一次, 其余请求等待该次下载的结果
+type ChunkCache struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	curBytes int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*chunkCall
+}
+
+type chunkCacheEntry struct {
+	key  string
+	data []byte
+}
+
+type chunkCall struct {
+	done    chan struct{}
+	data    []byte
+	err     error
+	waiters int
+}
+
+// NewChunkCache 创建分块缓存, maxBytes 为内存上限, 不大于 0 时只合并并发请求而不缓存数据
+func NewChunkCache(maxBytes int64) *ChunkCache {
+	return &ChunkCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*chunkCall),
+	}
+}
+
+// ChunkCacheKey 返回分块的缓存键, 键中包含 validator, 源站文件变化后不会读到旧文件的分块
+func ChunkCacheKey(url string, validator CacheValidator, start int64, end int64) string {
+	return fmt.Sprintf("%s#%s#%s#%d-%d", url, validator.ETag, validator.LastModified, start, end)
+}
+
+// Get 读取缓存的分块, 返回的数据为共享只读数据
+func (c *ChunkCache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, found := c.entries[key]; found {
+		c.lru.MoveToFront(element)
+		return element.Value.(*chunkCacheEntry).data, true
+	}
+	return nil, false
+}
+
+// Fetch 优先从缓存读取分块, 未命中时调用 fetch 下载并写入缓存
+// 启用缓存时返回的数据为共享只读数据
+func (c *ChunkCache) Fetch(key string, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mutex.Lock()
+	if element, found := c.entries[key]; found {
+		c.lru.MoveToFront(element)
+		c.mutex.Unlock()
+		return element.Value.(*chunkCacheEntry).data, nil
+	}
+	if call, found := c.inflight[key]; found {
+		call.waiters++
+		c.mutex.Unlock()
+		<-call.done
+		return call.data, call.err
+	}
+	call := &chunkCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mutex.Unlock()
+
+	call.data, call.err = fetch()
+
+	c.mutex.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.store(key, call.data)
+	}
+	c.mutex.Unlock()
+	data := call.data
+	if call.err == nil && call.waiters > 0 && !c.Enabled() {
+		// 未启用缓存时发起方的数据可能被复用, 等待方使用副本
+		call.data = append([]byte(nil), data...)
+	}
+	close(call.done)
+	return data, call.err
+}
+
+// Enabled 返回是否缓存数据, 未启用时 Fetch 返回的数据归调用方所有
+func (c *ChunkCache) Enabled() bool {
+	return c.maxBytes > 0
+}
+
+// Size 返回当前缓存占用的字节数
+func (c *ChunkCache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.curBytes
+}
+
+func (c *ChunkCache) store(key string, data []byte) {
+	size := int64(len(data))
+	if size == 0 || size > c.maxBytes {
+		return
+	}
+	if element, found := c.entries[key]; found {
+		c.remove(element)
+	}
+	for c.curBytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&chunkCacheEntry{key: key, data: data})
+	c.curBytes += size
+}
+
+func (c *ChunkCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*chunkCacheEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= int64(len(entry.data))
+}
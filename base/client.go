@@ -1,12 +1,10 @@
 package base
 
 import (
-	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"net"
 	"net/http"
 	"time"
+
 	"github.com/go-resty/resty/v2"
 )
 
@@ -15,11 +13,9 @@ var (
 	NoRedirectClientWithProxy *resty.Client
 	RestyClient               *resty.Client
 	RestyClientWithProxy      *resty.Client
+	HedgeClient               *resty.Client // 每次请求都使用新连接, 用于对冲请求
 	HttpClient                *http.Client
-	DnsResolverIP             string  // 初始化为空字符串
 	IdleConnTimeout           = 10 * time.Second
-	dnsResolverProto          = "udp"
-	dnsResolverTimeoutMs      = 10000
 )
 var UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36"
 var DefaultTimeout = time.Second * 30
@@ -29,17 +25,22 @@ func InitClient() {
 		resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		}),
-	).SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	).SetTLSClientConfig(NewTLSClientConfig())
 	NoRedirectClient.SetHeader("user-agent", UserAgent)
 
 	NoRedirectClientWithProxy = resty.New().SetRedirectPolicy(
 		resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		}),
-	)
+	).SetTLSClientConfig(NewTLSClientConfig())
 	NoRedirectClientWithProxy.SetHeader("user-agent", UserAgent)
+	NoRedirectClientWithProxy.GetClient().Transport.(*http.Transport).Proxy = UpstreamProxy
 	RestyClient = NewRestyClient()
 	RestyClientWithProxy = NewRestyClient()
+	httpTransport(RestyClientWithProxy).Proxy = UpstreamProxy
+	HedgeClient = NewRestyClient()
+	httpTransport(HedgeClient).DisableKeepAlives = true
+	httpTransport(HedgeClient).Proxy = UpstreamProxy
 	HttpClient = NewHttpClient()
 }
 
@@ -48,24 +49,16 @@ func NewRestyClient() *resty.Client {
 		// Timeout: ConnectTimeout * time.Second, // 设置连接超时为
 		Resolver: &net.Resolver{
 			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
-				}
-				return d.DialContext(ctx, dnsResolverProto, DnsResolverIP)
-			},
+			Dial:     dialDNS,
 		},
 	}
 
+	dial := dialWithLocalAddr(dialer)
 	transport := &http.Transport{
-		DialContext: dialer.DialContext,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			VerifyPeerCertificate: func(certificates [][]byte, _ [][]*x509.Certificate) error {
-				// 完全忽略证书验证
-				return nil
-			},
-		},
+		DialContext: dial,
+		// 直连时按域名选择客户端证书与 TLS 指纹, 证书按 ConfigureTLS 的策略验证
+		DialTLSContext:  dialTLS(dial, http1Protos),
+		TLSClientConfig: NewTLSClientConfig(),
 		IdleConnTimeout: IdleConnTimeout,
 	}
 
@@ -73,29 +66,43 @@ func NewRestyClient() *resty.Client {
 		SetHeader("user-agent", UserAgent).
 		SetRetryCount(3).
 		SetTimeout(DefaultTimeout).
-		SetTransport(transport)
+		SetTransport(newUpstreamTransport(transport, dialer.Resolver))
 	return client
 }
 
+// httpTransport 返回 NewRestyClient 创建的客户端底层的 http.Transport, 用于修改代理等设置
+func httpTransport(client *resty.Client) *http.Transport {
+	return client.GetClient().Transport.(*upstreamTransport).Transport
+}
+
+// SessionClient 返回与 client 共用连接池的新客户端, 用于设置单次会话的超时、重试次数与 Cookie
+// 各会话不再修改全局客户端, 避免并发请求之间相互覆盖设置
+func SessionClient(client *resty.Client, jar http.CookieJar, timeout time.Duration, retryCount int) *resty.Client {
+	return resty.NewWithClient(&http.Client{
+		Transport: client.GetClient().Transport,
+		Jar:       jar,
+		Timeout:   timeout,
+	}).
+		SetHeader("user-agent", UserAgent).
+		SetRetryCount(retryCount)
+}
+
 func NewHttpClient() *http.Client {
 	dialer := &net.Dialer{
 		// Timeout: ConnectTimeout, // 设置连接超时为
 		Resolver: &net.Resolver{
 			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
-				}
-				return d.DialContext(ctx, dnsResolverProto, DnsResolverIP)
-			},
+			Dial:     dialDNS,
 		},
 	}
 
+	dial := dialWithLocalAddr(dialer)
 	return &http.Client{
 		Timeout: time.Hour * 48,
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			DialContext:     dialer.DialContext,
+			TLSClientConfig: NewTLSClientConfig(),
+			DialContext:     dial,
+			DialTLSContext:  dialTLS(dial, http1Protos),
 			IdleConnTimeout: IdleConnTimeout,
 		},
 	}
@@ -0,0 +1,277 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	localAddrMaxFailures     = 3                // 连续失败多少次后暂停使用该出口
+	localAddrDisableDuration = 30 * time.Second // 暂停使用的时长
+
+	ipDialTimeout     = 5 * time.Second  // 域名解析出多个 IP 时单个 IP 的连接超时
+	ipLatencyLifetime = 10 * time.Minute // 测得的连接耗时的有效期, 过期后重新测量
+)
+
+// localAddr 表示一个出口, 可以是本机 IP 或网卡名称
+type localAddr struct {
+	name          string
+	ip            net.IP // 网卡出口为 nil, 每次连接时读取网卡当前的地址
+	failures      int
+	disabledUntil time.Time
+}
+
+var (
+	localAddrMutex sync.Mutex
+	localAddrs     []*localAddr
+	localAddrNext  int
+)
+
+// ipLatency 记录连接某个 IP 的耗时
+type ipLatency struct {
+	latency time.Duration // 连接耗时的滑动平均值, 连接失败按超时计算
+	updated time.Time
+}
+
+var (
+	fastestIPEnabled bool
+	ipLatencyMutex   sync.Mutex
+	ipLatencies      = make(map[string]*ipLatency)
+)
+
+// EnableFastestIP 开启按实测连接耗时选择 IP, 域名解析出多个 IP 时优先连接耗时最短的 IP, 需在处理请求前调用
+func EnableFastestIP() {
+	fastestIPEnabled = true
+}
+
+func recordIPLatency(ip string, latency time.Duration) {
+	ipLatencyMutex.Lock()
+	defer ipLatencyMutex.Unlock()
+	record, found := ipLatencies[ip]
+	if !found || time.Since(record.updated) > ipLatencyLifetime {
+		ipLatencies[ip] = &ipLatency{latency: latency, updated: time.Now()}
+		return
+	}
+	record.latency = (record.latency*7 + latency*3) / 10
+	record.updated = time.Now()
+}
+
+// sortIPsByLatency 按连接耗时排序, 未测量或测量已过期的 IP 排在最前以便测量
+func sortIPsByLatency(ips []net.IPAddr) {
+	ipLatencyMutex.Lock()
+	defer ipLatencyMutex.Unlock()
+	now := time.Now()
+	latency := func(ip net.IPAddr) time.Duration {
+		record, found := ipLatencies[ip.String()]
+		if !found || now.Sub(record.updated) > ipLatencyLifetime {
+			return -1
+		}
+		return record.latency
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return latency(ips[i]) < latency(ips[j])
+	})
+}
+
+// dialFastest 解析域名后按连接耗时依次连接各 IP, 连接失败时尝试下一个 IP
+func dialFastest(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	if !fastestIPEnabled {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	resolver := dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	resolved, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// 只保留与网络类型及本机出口地址族一致的 IP
+	var localIP net.IP
+	if tcpAddr, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	ips := resolved[:0]
+	for _, ip := range resolved {
+		isIPv4 := ip.IP.To4() != nil
+		if (network == "tcp4" && !isIPv4) || (network == "tcp6" && isIPv4) {
+			continue
+		}
+		if localIP != nil && (localIP.To4() != nil) != isIPv4 {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	sortIPsByLatency(ips)
+
+	var lastErr error
+	for _, ip := range ips {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if len(ips) > 1 {
+			attemptCtx, cancel = context.WithTimeout(ctx, ipDialTimeout)
+		}
+		start := time.Now()
+		conn, err := dialer.DialContext(attemptCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			recordIPLatency(ip.String(), time.Since(start))
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		recordIPLatency(ip.String(), ipDialTimeout)
+		logrus.Debugf("连接 %s(%s) 失败, 尝试下一个 IP: %v", host, ip.String(), err)
+	}
+	return nil, lastErr
+}
+
+// ConfigureLocalAddresses 设置发起连接时使用的本机出口, 每项为本机 IP 或网卡名称, 需在处理请求前调用
+// 新建连接按轮询方式分配到各出口, 使同一会话的分块连接分散到多条线路上
+func ConfigureLocalAddresses(addrs []string) error {
+	parsed := make([]*localAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		entry := &localAddr{name: addr, ip: net.ParseIP(addr)}
+		if entry.ip == nil {
+			if _, err := net.InterfaceByName(addr); err != nil {
+				return fmt.Errorf("出口 %s 既不是 IP 也不是网卡: %v", addr, err)
+			}
+		}
+		parsed = append(parsed, entry)
+	}
+	localAddrMutex.Lock()
+	defer localAddrMutex.Unlock()
+	localAddrs = parsed
+	localAddrNext = 0
+	return nil
+}
+
+// ips 返回出口可用的本机地址, IPv4 在前
+func (a *localAddr) ips() ([]net.IP, error) {
+	if a.ip != nil {
+		return []net.IP{a.ip}, nil
+	}
+	iface, err := net.InterfaceByName(a.name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipv4, ipv6 []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			ipv4 = append(ipv4, ipNet.IP)
+		} else {
+			ipv6 = append(ipv6, ipNet.IP)
+		}
+	}
+	if len(ipv4)+len(ipv6) == 0 {
+		return nil, fmt.Errorf("网卡 %s 没有可用地址", a.name)
+	}
+	return append(ipv4, ipv6...), nil
+}
+
+// nextLocalAddrs 按轮询顺序返回本次连接依次尝试的出口, 暂停中的出口排在最后
+func nextLocalAddrs() []*localAddr {
+	localAddrMutex.Lock()
+	defer localAddrMutex.Unlock()
+	if len(localAddrs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var available, disabled []*localAddr
+	for i := range localAddrs {
+		entry := localAddrs[(localAddrNext+i)%len(localAddrs)]
+		if entry.disabledUntil.After(now) {
+			disabled = append(disabled, entry)
+		} else {
+			available = append(available, entry)
+		}
+	}
+	localAddrNext = (localAddrNext + 1) % len(localAddrs)
+	return append(available, disabled...)
+}
+
+// report 记录出口的连接结果, 连续失败达到上限时暂停使用
+func (a *localAddr) report(err error) {
+	localAddrMutex.Lock()
+	defer localAddrMutex.Unlock()
+	if err == nil {
+		if !a.disabledUntil.IsZero() {
+			logrus.Infof("出口 %s 已恢复", a.name)
+			a.disabledUntil = time.Time{}
+		}
+		a.failures = 0
+		return
+	}
+	a.failures++
+	if a.failures >= localAddrMaxFailures && !a.disabledUntil.After(time.Now()) {
+		a.failures = 0
+		a.disabledUntil = time.Now().Add(localAddrDisableDuration)
+		logrus.Warnf("出口 %s 连续连接失败 %d 次, 暂停使用 %v: %v", a.name, localAddrMaxFailures, localAddrDisableDuration, err)
+	}
+}
+
+// dialWithLocalAddr 包装 dialer, 配置了本机出口时从轮询到的出口发起连接, 失败时换下一个出口重试
+func dialWithLocalAddr(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		candidates := nextLocalAddrs()
+		if len(candidates) == 0 {
+			return dialFastest(ctx, dialer, network, address)
+		}
+		var lastErr error
+		for _, entry := range candidates {
+			ips, err := entry.ips()
+			if err != nil {
+				entry.report(err)
+				lastErr = err
+				continue
+			}
+			var dialErr error
+			for _, ip := range ips {
+				d := *dialer
+				d.LocalAddr = &net.TCPAddr{IP: ip}
+				conn, err := dialFastest(ctx, &d, network, address)
+				if err == nil {
+					entry.report(nil)
+					return conn, nil
+				}
+				lastErr = err
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				var addrErr *net.AddrError
+				if !errors.As(err, &addrErr) {
+					// 地址族与源站不匹配不计为出口故障
+					dialErr = err
+				}
+			}
+			if dialErr != nil {
+				entry.report(dialErr)
+				logrus.Debugf("从出口 %s 连接 %s 失败: %v", entry.name, address, dialErr)
+			}
+		}
+		return nil, lastErr
+	}
+}
@@ -0,0 +1,396 @@
+package base
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CacheValidator 用于判断缓存内容与源站文件是否一致
+type CacheValidator struct {
+	ETag         string
+	LastModified string
+	Size         int64
+}
+
+// 元数据变化后最长延迟多久写入磁盘
+const diskCacheFlushInterval = 5 * time.Second
+
+// DiskCache 将下载的分块以稀疏文件形式保存在磁盘上, 重启后仍可使用
+// 每个 URL 对应一个 .data 数据文件和一个 .json 元数据文件, 超出上限时按最近访问时间淘汰
+// 元数据只在内存中标记为待保存, 由后台定期在锁外批量写入; 淘汰的文件同样在锁外删除, 避免磁盘操作阻塞其它会话
+type DiskCache struct {
+	mutex    sync.Mutex
+	dir      string
+	maxBytes int64
+	curBytes int64
+	entries  map[string]*diskCacheEntry
+	dirty    map[string]*diskCacheEntry
+	removing map[string]int // 正在锁外删除文件的缓存项, 删除完成前不重新创建
+	flushMu  sync.Mutex     // 保证同一时间只有一个 flush 在写元数据文件
+}
+
+type diskCacheEntry struct {
+	URL          string     `json:"url"`
+	ETag         string     `json:"etag"`
+	LastModified string     `json:"lastModified"`
+	Size         int64      `json:"size"`
+	Ranges       [][2]int64 `json:"ranges"` // 已缓存的闭区间, 按起点排序且互不相邻
+	LastAccess   int64      `json:"lastAccess"`
+
+	id        string
+	savedTime int64
+}
+
+// NewDiskCache 创建磁盘缓存并加载目录中已有的元数据
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*diskCacheEntry),
+		dirty:    make(map[string]*diskCacheEntry),
+		removing: make(map[string]int),
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, metaFile := range metaFiles {
+		id := strings.TrimSuffix(filepath.Base(metaFile), ".json")
+		data, err := os.ReadFile(metaFile)
+		if err != nil {
+			continue
+		}
+		entry := &diskCacheEntry{}
+		if json.Unmarshal(data, entry) != nil || diskCacheID(entry.URL) != id {
+			c.removeFiles(id)
+			continue
+		}
+		if _, err := os.Stat(c.dataPath(id)); err != nil {
+			c.removeFiles(id)
+			continue
+		}
+		entry.id = id
+		entry.savedTime = entry.LastAccess
+		c.entries[id] = entry
+		c.curBytes += entry.cachedBytes()
+	}
+	// 清理没有元数据的数据文件
+	dataFiles, _ := filepath.Glob(filepath.Join(dir, "*.data"))
+	for _, dataFile := range dataFiles {
+		if _, found := c.entries[strings.TrimSuffix(filepath.Base(dataFile), ".data")]; !found {
+			os.Remove(dataFile)
+		}
+	}
+	c.mutex.Lock()
+	removed := c.evict("")
+	c.mutex.Unlock()
+	c.removeEntries(removed)
+	logrus.Infof("磁盘缓存目录: %s, 已加载 %d 个文件, 共 %d 字节", dir, len(c.entries), c.curBytes)
+	go func() {
+		for range time.Tick(diskCacheFlushInterval) {
+			c.Flush()
+		}
+	}()
+	return c, nil
+}
+
+func diskCacheID(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *DiskCache) dataPath(id string) string {
+	return filepath.Join(c.dir, id+".data")
+}
+
+func (c *DiskCache) metaPath(id string) string {
+	return filepath.Join(c.dir, id+".json")
+}
+
+func (c *DiskCache) removeFiles(id string) {
+	os.Remove(c.dataPath(id))
+	os.Remove(c.metaPath(id))
+}
+
+// drop 从索引中删除缓存项并登记为正在删除, 调用方需持有锁, 解锁后需对返回的 id 调用 removeEntries
+func (c *DiskCache) drop(entry *diskCacheEntry) string {
+	c.curBytes -= entry.cachedBytes()
+	delete(c.entries, entry.id)
+	delete(c.dirty, entry.id)
+	c.removing[entry.id]++
+	return entry.id
+}
+
+// removeEntries 在锁外删除 drop 返回的缓存项的文件
+func (c *DiskCache) removeEntries(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	for _, id := range ids {
+		c.removeFiles(id)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, id := range ids {
+		if c.removing[id]--; c.removing[id] <= 0 {
+			delete(c.removing, id)
+		}
+	}
+}
+
+func (e *diskCacheEntry) cachedBytes() int64 {
+	total := int64(0)
+	for _, r := range e.Ranges {
+		total += r[1] - r[0] + 1
+	}
+	return total
+}
+
+func (e *diskCacheEntry) matches(validator CacheValidator) bool {
+	if e.ETag != "" && validator.ETag != "" && e.ETag != validator.ETag {
+		return false
+	}
+	if e.LastModified != "" && validator.LastModified != "" && e.LastModified != validator.LastModified {
+		return false
+	}
+	if e.Size > 0 && validator.Size > 0 && e.Size != validator.Size {
+		return false
+	}
+	return true
+}
+
+// lookup 获取与 validator 一致的缓存项, 调用方需持有锁
+// 源站文件已变化时从索引中删除旧缓存, 返回的 removed 需在解锁后交给 removeEntries
+func (c *DiskCache) lookup(url string, validator CacheValidator) (entry *diskCacheEntry, removed []string) {
+	entry, found := c.entries[diskCacheID(url)]
+	if !found {
+		return nil, nil
+	}
+	if !entry.matches(validator) {
+		logrus.Debugf("磁盘缓存已失效: %s", url)
+		return nil, []string{c.drop(entry)}
+	}
+	return entry, nil
+}
+
+// ReadRange 将 [start, end] 区间中已缓存的部分读入 buffer, 返回尚未缓存的区间
+func (c *DiskCache) ReadRange(url string, validator CacheValidator, start int64, end int64, buffer []byte) [][2]int64 {
+	missing := [][2]int64{{start, end}}
+
+	c.mutex.Lock()
+	entry, removed := c.lookup(url, validator)
+	if entry == nil {
+		c.mutex.Unlock()
+		c.removeEntries(removed)
+		return missing
+	}
+	var covered [][2]int64
+	for _, r := range entry.Ranges {
+		if r[1] < start || r[0] > end {
+			continue
+		}
+		covered = append(covered, [2]int64{max(r[0], start), min(r[1], end)})
+	}
+	entry.LastAccess = time.Now().UnixNano()
+	if len(covered) > 0 && entry.LastAccess-entry.savedTime > int64(time.Minute) {
+		c.dirty[entry.id] = entry
+	}
+	id := entry.id
+	c.mutex.Unlock()
+
+	if len(covered) == 0 {
+		return missing
+	}
+	file, err := os.Open(c.dataPath(id))
+	if err != nil {
+		return missing
+	}
+	defer file.Close()
+
+	missing = nil
+	next := start
+	for _, r := range covered {
+		if _, err := file.ReadAt(buffer[r[0]-start:r[1]-start+1], r[0]); err != nil {
+			logrus.Errorf("读取磁盘缓存失败: %v", err)
+			return [][2]int64{{start, end}}
+		}
+		if r[0] > next {
+			missing = append(missing, [2]int64{next, r[0] - 1})
+		}
+		next = r[1] + 1
+	}
+	if next <= end {
+		missing = append(missing, [2]int64{next, end})
+	}
+	return missing
+}
+
+// WriteRange 将从 start 开始的数据写入磁盘缓存
+func (c *DiskCache) WriteRange(url string, validator CacheValidator, start int64, data []byte) {
+	if len(data) == 0 || int64(len(data)) > c.maxBytes {
+		return
+	}
+	end := start + int64(len(data)) - 1
+
+	c.mutex.Lock()
+	entry, removed := c.lookup(url, validator)
+	if entry == nil {
+		if c.removing[diskCacheID(url)] > 0 {
+			// 旧文件尚未删除完, 本次不写入缓存
+			c.mutex.Unlock()
+			c.removeEntries(removed)
+			return
+		}
+		entry = &diskCacheEntry{
+			URL:          url,
+			ETag:         validator.ETag,
+			LastModified: validator.LastModified,
+			Size:         validator.Size,
+			id:           diskCacheID(url),
+		}
+		c.entries[entry.id] = entry
+	}
+	id := entry.id
+	c.mutex.Unlock()
+
+	file, err := os.OpenFile(c.dataPath(id), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logrus.Errorf("打开磁盘缓存失败: %v", err)
+		return
+	}
+	if validator.Size > 0 {
+		if info, err := file.Stat(); err == nil && info.Size() < validator.Size {
+			// 预设文件大小, 未写入的部分不占用磁盘空间
+			file.Truncate(validator.Size)
+		}
+	}
+	_, err = file.WriteAt(data, start)
+	file.Close()
+	if err != nil {
+		logrus.Errorf("写入磁盘缓存失败: %v", err)
+		return
+	}
+
+	c.mutex.Lock()
+	if c.entries[id] != entry {
+		// 写入期间缓存项已被淘汰
+		c.mutex.Unlock()
+		return
+	}
+	c.curBytes -= entry.cachedBytes()
+	entry.Ranges = mergeRanges(append(entry.Ranges, [2]int64{start, end}))
+	c.curBytes += entry.cachedBytes()
+	entry.LastAccess = time.Now().UnixNano()
+	c.dirty[id] = entry
+	removed = c.evict(id)
+	c.mutex.Unlock()
+	c.removeEntries(removed)
+}
+
+// evict 按最近访问时间淘汰缓存直到不超过上限, keepID 对应的缓存项最后淘汰
+// 调用方需持有锁, 返回的 id 需在解锁后交给 removeEntries
+func (c *DiskCache) evict(keepID string) []string {
+	if c.curBytes <= c.maxBytes {
+		return nil
+	}
+	entries := make([]*diskCacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if (entries[i].id == keepID) != (entries[j].id == keepID) {
+			return entries[j].id == keepID
+		}
+		return entries[i].LastAccess < entries[j].LastAccess
+	})
+	var removed []string
+	for _, entry := range entries {
+		if c.curBytes <= c.maxBytes {
+			break
+		}
+		logrus.Debugf("淘汰磁盘缓存: %s", entry.URL)
+		removed = append(removed, c.drop(entry))
+	}
+	return removed
+}
+
+// Flush 将待保存的元数据写入磁盘
+// 在锁内序列化, 在锁外写文件; 写入期间被淘汰或重建的缓存项随后删除其元数据文件
+func (c *DiskCache) Flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mutex.Lock()
+	if len(c.dirty) == 0 {
+		c.mutex.Unlock()
+		return
+	}
+	type pendingMeta struct {
+		entry *diskCacheEntry
+		data  []byte
+	}
+	pending := make(map[string]pendingMeta, len(c.dirty))
+	for id, entry := range c.dirty {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		pending[id] = pendingMeta{entry: entry, data: data}
+		entry.savedTime = entry.LastAccess
+	}
+	c.dirty = make(map[string]*diskCacheEntry)
+	c.mutex.Unlock()
+
+	for id, meta := range pending {
+		tmpPath := c.metaPath(id) + ".tmp"
+		if err := os.WriteFile(tmpPath, meta.data, 0644); err != nil {
+			logrus.Errorf("保存磁盘缓存元数据失败: %v", err)
+			continue
+		}
+		os.Rename(tmpPath, c.metaPath(id))
+	}
+
+	var stale []string
+	c.mutex.Lock()
+	for id, meta := range pending {
+		if c.entries[id] != meta.entry {
+			stale = append(stale, id)
+		}
+	}
+	c.mutex.Unlock()
+	for _, id := range stale {
+		// 重建的缓存项已标记为待保存, 下次 Flush 时写入新的元数据
+		os.Remove(c.metaPath(id))
+	}
+}
+
+// mergeRanges 合并重叠或相邻的区间
+func mergeRanges(ranges [][2]int64) [][2]int64 {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1]+1 {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,167 @@
+package base
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DNSUpstreamStatus 为上游 DNS 服务器的状态, 用于 /dns 接口
+type DNSUpstreamStatus struct {
+	Server     string    `json:"server"`
+	Proto      string    `json:"proto"`
+	Current    bool      `json:"current"`
+	LatencyMs  float64   `json:"latencyMs"` // 最近一次测速的耗时, 失败时为 -1, 未测速时为 0
+	UDPLatency float64   `json:"udpLatencyMs,omitempty"`
+	TCPLatency float64   `json:"tcpLatencyMs,omitempty"`
+	Checked    time.Time `json:"checked"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var dnsBenchmarkDomain = "baidu.com"
+
+// StartDNSBenchmark 立即测速一次所有上游 DNS 服务器并按耗时排序, 之后每隔 interval 在后台重新测速
+// 未指定协议的服务器同时测量 UDP 与 TCP, 使用其中较快且可用的一种
+func StartDNSBenchmark(domain string, interval time.Duration) {
+	if domain != "" {
+		dnsBenchmarkDomain = domain
+	}
+	BenchmarkDNS()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			BenchmarkDNS()
+		}
+	}()
+}
+
+// BenchmarkDNS 并发测速所有上游 DNS 服务器, 按耗时重新排序, 测速失败的排在最后
+func BenchmarkDNS() {
+	dnsUpstreamMutex.Lock()
+	upstreams := dnsUpstreams
+	var current *dnsUpstream
+	if len(upstreams) > 0 {
+		current = upstreams[dnsPreferred]
+	}
+	dnsUpstreamMutex.Unlock()
+
+	measured := make([]*dnsUpstream, len(upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(i int, upstream *dnsUpstream) {
+			defer wg.Done()
+			measured[i] = upstream.benchmark(dnsBenchmarkDomain)
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	sort.SliceStable(measured, func(i, j int) bool {
+		a, b := measured[i].latency, measured[j].latency
+		if (a < 0) != (b < 0) {
+			return b < 0
+		}
+		return a < b
+	})
+	for _, upstream := range measured {
+		if upstream.latency < 0 {
+			logrus.Debugf("DNS 服务器 %s 测速失败: %s", upstream.server, upstream.lastError)
+		} else {
+			logrus.Debugf("DNS 服务器 %s 测速耗时 %v", upstream, upstream.latency)
+		}
+	}
+
+	dnsUpstreamMutex.Lock()
+	defer dnsUpstreamMutex.Unlock()
+	if len(dnsUpstreams) != len(upstreams) || (len(upstreams) > 0 && dnsUpstreams[0] != upstreams[0]) {
+		// 测速期间配置已被替换
+		return
+	}
+	dnsUpstreams = measured
+	dnsPreferred = 0
+	if len(measured) > 0 && (current == nil || measured[0].server != current.server || measured[0].proto != current.proto) {
+		logrus.Infof("DNS 服务器切换至 %s, 耗时 %v", measured[0], measured[0].latency)
+	}
+}
+
+// benchmark 返回带有测速结果的副本
+func (u *dnsUpstream) benchmark(domain string) *dnsUpstream {
+	result := *u
+	result.checked = time.Now()
+	result.udpLatency, result.tcpLatency = 0, 0
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	query, err := msg.Pack()
+	if err != nil {
+		result.latency = -1
+		result.lastError = err.Error()
+		return &result
+	}
+
+	measure := func(proto string) (time.Duration, error) {
+		probe := *u
+		probe.proto = proto
+		ctx, cancel := context.WithTimeout(context.Background(), dnsUpstreamTimeout)
+		defer cancel()
+		start := time.Now()
+		if _, err := probe.exchange(ctx, query); err != nil {
+			return -1, err
+		}
+		return time.Since(start), nil
+	}
+
+	if !u.plain {
+		result.latency, err = measure(u.proto)
+	} else {
+		var udpErr, tcpErr error
+		result.udpLatency, udpErr = measure("udp")
+		result.tcpLatency, tcpErr = measure("tcp")
+		switch {
+		case udpErr == nil && (tcpErr != nil || result.udpLatency <= result.tcpLatency):
+			result.proto, result.latency = "udp", result.udpLatency
+		case tcpErr == nil:
+			result.proto, result.latency = "tcp", result.tcpLatency
+		default:
+			result.proto, result.latency, err = "udp", -1, udpErr
+		}
+	}
+	result.lastError = ""
+	if err != nil {
+		result.lastError = err.Error()
+	}
+	return &result
+}
+
+// DNSStatus 返回所有上游 DNS 服务器的状态, 按当前使用顺序排列
+func DNSStatus() []DNSUpstreamStatus {
+	dnsUpstreamMutex.Lock()
+	defer dnsUpstreamMutex.Unlock()
+	milliseconds := func(d time.Duration) float64 {
+		if d < 0 {
+			return -1
+		}
+		return float64(d.Microseconds()) / 1000
+	}
+	status := make([]DNSUpstreamStatus, 0, len(dnsUpstreams))
+	for i := range dnsUpstreams {
+		upstream := dnsUpstreams[(dnsPreferred+i)%len(dnsUpstreams)]
+		status = append(status, DNSUpstreamStatus{
+			Server:     upstream.server,
+			Proto:      upstream.proto,
+			Current:    i == 0,
+			LatencyMs:  milliseconds(upstream.latency),
+			UDPLatency: milliseconds(upstream.udpLatency),
+			TCPLatency: milliseconds(upstream.tcpLatency),
+			Checked:    upstream.checked,
+			Error:      upstream.lastError,
+		})
+	}
+	return status
+}
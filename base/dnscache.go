@@ -0,0 +1,204 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	staticHostTTL      = 60 // 静态 hosts 响应的 TTL, 单位秒
+	dnsCacheMaxEntries = 10000
+)
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+var (
+	dnsCacheMutex   sync.Mutex
+	dnsCacheEnabled bool
+	dnsCacheMinTTL  time.Duration
+	dnsCacheMaxTTL  time.Duration
+	dnsCacheEntries = make(map[string]*dnsCacheEntry)
+	staticHosts     = make(map[string][]net.IP) // 键为小写的完整域名, "*." 开头的键匹配所有子域名
+)
+
+// ConfigureDNSCache 开启 A/AAAA 等查询结果的缓存, 缓存时长取响应中的 TTL 并限制在 minTTL 与 maxTTL 之间
+func ConfigureDNSCache(minTTL time.Duration, maxTTL time.Duration) {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	dnsCacheEnabled = true
+	dnsCacheMinTTL = minTTL
+	dnsCacheMaxTTL = max(maxTTL, minTTL)
+}
+
+// ConfigureHosts 设置静态解析, 用于将 CDN 域名固定到指定 IP, 键可以使用 "*.example.com" 匹配子域名
+func ConfigureHosts(hosts map[string][]string) error {
+	parsed := make(map[string][]net.IP, len(hosts))
+	for host, addrs := range hosts {
+		var ips []net.IP
+		for _, addr := range addrs {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil {
+				return fmt.Errorf("hosts 中 %s 的地址 %s 无效", host, addr)
+			}
+			ips = append(ips, ip)
+		}
+		parsed[strings.ToLower(strings.TrimSuffix(host, "."))] = ips
+	}
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	staticHosts = parsed
+	return nil
+}
+
+// lookupStaticHost 查找静态解析, 完整域名优先, 其次匹配最长的通配符
+func lookupStaticHost(name string) ([]net.IP, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	if ips, found := staticHosts[name]; found {
+		return ips, true
+	}
+	for suffix := name; ; {
+		index := strings.IndexByte(suffix, '.')
+		if index < 0 {
+			return nil, false
+		}
+		suffix = suffix[index+1:]
+		if ips, found := staticHosts["*."+suffix]; found {
+			return ips, true
+		}
+	}
+}
+
+// resolveDNS 处理 net.Resolver 发出的查询, 依次使用静态解析、缓存与上游 DNS 服务器
+func resolveDNS(ctx context.Context, query []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return exchangeDNS(ctx, query)
+	}
+	question := msg.Question[0]
+
+	if ips, found := lookupStaticHost(question.Name); found && (question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA) {
+		return staticHostReply(msg, ips).Pack()
+	}
+
+	key := fmt.Sprintf("%s|%d|%d", strings.ToLower(question.Name), question.Qtype, question.Qclass)
+	if reply := cachedDNSReply(key, msg.Id); reply != nil {
+		return reply.Pack()
+	}
+
+	response, err := exchangeDNS(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	storeDNSReply(key, response)
+	return response, nil
+}
+
+func staticHostReply(query *dns.Msg, ips []net.IP) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.RecursionAvailable = true
+	question := query.Question[0]
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: staticHostTTL}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && question.Qtype == dns.TypeA {
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: header, A: ip4})
+		} else if ip4 == nil && question.Qtype == dns.TypeAAAA {
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return reply
+}
+
+// cachedDNSReply 返回缓存的响应, 其中的 TTL 已减去缓存时长, 未命中或已过期时返回 nil
+func cachedDNSReply(key string, id uint16) *dns.Msg {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	if !dnsCacheEnabled {
+		return nil
+	}
+	entry, found := dnsCacheEntries[key]
+	if !found {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		delete(dnsCacheEntries, key)
+		return nil
+	}
+	reply := entry.msg.Copy()
+	reply.Id = id
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	remaining := uint32(entry.expires.Sub(now)/time.Second) + 1
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			header.Ttl = min(max(header.Ttl, elapsed)-elapsed, remaining)
+		}
+	}
+	return reply
+}
+
+// storeDNSReply 缓存上游的响应, 否定响应按 SOA 的 TTL 缓存, 其余错误不缓存
+func storeDNSReply(key string, response []byte) {
+	dnsCacheMutex.Lock()
+	enabled := dnsCacheEnabled
+	dnsCacheMutex.Unlock()
+	if !enabled {
+		return
+	}
+	msg := new(dns.Msg)
+	if msg.Unpack(response) != nil || msg.Truncated {
+		return
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	var ttl uint32
+	found := false
+	records := msg.Answer
+	if len(records) == 0 {
+		records = msg.Ns
+	}
+	for _, rr := range records {
+		header := rr.Header()
+		if !found || header.Ttl < ttl {
+			ttl = header.Ttl
+			found = true
+		}
+	}
+
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	duration := min(max(time.Duration(ttl)*time.Second, dnsCacheMinTTL), dnsCacheMaxTTL)
+	if duration <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(dnsCacheEntries) >= dnsCacheMaxEntries {
+		for k, entry := range dnsCacheEntries {
+			if !now.Before(entry.expires) {
+				delete(dnsCacheEntries, k)
+			}
+		}
+		if len(dnsCacheEntries) >= dnsCacheMaxEntries {
+			return
+		}
+	}
+	dnsCacheEntries[key] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(duration)}
+}
@@ -2,16 +2,17 @@ package base
 
 import (
 	"io"
+	"sync/atomic"
 )
 
 type Emitter struct {
 	pipeReader *io.PipeReader
 	pipeWriter *io.PipeWriter
-	closed     bool
+	closed     atomic.Bool
 }
 
 func (em *Emitter) IsClosed() bool {
-	return em.closed
+	return em.closed.Load()
 }
 
 func (em *Emitter) Read(b []byte) (int, error) {
@@ -37,7 +38,7 @@ func (em *Emitter) WriteString(s string) (int, error) {
 }
 
 func (em *Emitter) Close() error {
-	em.closed = true
+	em.closed.Store(true)
 	em.pipeReader.Close()
 	em.pipeWriter.Close()
 	return nil
@@ -47,6 +48,5 @@ func NewEmitter(reader *io.PipeReader, writer *io.PipeWriter) *Emitter {
 	return &Emitter{
 		pipeReader: reader,
 		pipeWriter: writer,
-		closed:     false,
 	}
 }
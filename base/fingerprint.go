@@ -0,0 +1,79 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// parseFingerprint 解析浏览器 TLS 指纹名称, "go" 表示使用 Go 默认的握手
+func parseFingerprint(name string) (*utls.ClientHelloID, error) {
+	var id utls.ClientHelloID
+	switch strings.ToLower(name) {
+	case "go":
+		return nil, nil
+	case "chrome":
+		id = utls.HelloChrome_Auto
+	case "firefox":
+		id = utls.HelloFirefox_Auto
+	case "safari":
+		id = utls.HelloSafari_Auto
+	case "edge":
+		id = utls.HelloEdge_Auto
+	case "ios":
+		id = utls.HelloIOS_Auto
+	default:
+		return nil, fmt.Errorf("TLS 指纹 %s 不受支持, 可选 chrome、firefox、safari、edge、ios 或 go", name)
+	}
+	return &id, nil
+}
+
+// handshakeFingerprint 以指定浏览器的 ClientHello 完成握手
+// 浏览器总在 ALPN 中声明 h2, 连接只按 HTTP/1.1 使用时改为 nextProtos 中的协议
+func handshakeFingerprint(ctx context.Context, rawConn net.Conn, host string, fingerprint utls.ClientHelloID, nextProtos []string) (net.Conn, error) {
+	spec, err := utls.UTLSIdToSpec(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(nextProtos, "h2") {
+		for _, extension := range spec.Extensions {
+			switch extension := extension.(type) {
+			case *utls.ALPNExtension:
+				extension.AlpnProtocols = nextProtos
+			case *utls.ApplicationSettingsExtension:
+				extension.SupportedProtocols = nextProtos
+			}
+		}
+	}
+
+	clientCert := tlsPolicyFor(host).clientCert
+	config := &utls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs utls.ConnectionState) error {
+			return verifyPeerCertificates(host, cs.PeerCertificates)
+		},
+		GetClientCertificate: func(*utls.CertificateRequestInfo) (*utls.Certificate, error) {
+			if clientCert == nil {
+				return &utls.Certificate{}, nil
+			}
+			return &utls.Certificate{
+				Certificate: clientCert.Certificate,
+				PrivateKey:  clientCert.PrivateKey,
+				Leaf:        clientCert.Leaf,
+			}, nil
+		},
+	}
+	conn := utls.UClient(rawConn, config, utls.HelloCustom)
+	if err := conn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
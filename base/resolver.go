@@ -0,0 +1,342 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dnsUpstreamTimeout = 3 * time.Second // 单个上游 DNS 服务器的查询超时
+	dnsMaxMessageSize  = 65535
+)
+
+// dnsUpstream 表示一个上游 DNS 服务器, 发布后不再修改, 测速结果通过替换整个列表更新
+type dnsUpstream struct {
+	server  string // 配置中的原始地址
+	proto   string // udp、tcp、tls 或 https
+	address string // udp/tcp/tls 为 host:port, https 为完整 URL
+	plain   bool   // 未指定协议, 可按测速结果在 UDP 与 TCP 之间切换
+
+	latency    time.Duration // 最近一次测速的耗时, 失败时为 -1, 未测速时为 0
+	udpLatency time.Duration
+	tcpLatency time.Duration
+	checked    time.Time
+	lastError  string
+}
+
+var (
+	dnsUpstreamMutex sync.Mutex
+	dnsUpstreams     []*dnsUpstream
+	dnsPreferred     int // 最近一次查询成功的上游, 下次查询优先使用
+	// DoH/DoT 服务器自身的域名由系统 DNS 解析, 建议直接配置 IP
+	dnsBootstrapDialer = &net.Dialer{Timeout: dnsUpstreamTimeout}
+	dohClient          = &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dnsBootstrapDialer.DialContext,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		},
+	}
+)
+
+// ConfigureDNS 设置上游 DNS 服务器, 需在处理请求前调用
+// 支持 ip[:port]、udp://、tcp://、tls://host[:port] (DNS-over-TLS) 与 https:// (DNS-over-HTTPS)
+// 查询按顺序尝试各服务器, 失败时使用下一个
+func ConfigureDNS(servers []string) error {
+	upstreams := make([]*dnsUpstream, 0, len(servers))
+	for _, server := range servers {
+		upstream, err := parseDNSUpstream(server)
+		if err != nil {
+			return err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		return errors.New("未配置 DNS 服务器")
+	}
+	dnsUpstreamMutex.Lock()
+	defer dnsUpstreamMutex.Unlock()
+	dnsUpstreams = upstreams
+	dnsPreferred = 0
+	return nil
+}
+
+func parseDNSUpstream(server string) (*dnsUpstream, error) {
+	server = strings.TrimSpace(server)
+	rawURL := server
+	plain := !strings.Contains(server, "://")
+	if plain {
+		rawURL = "udp://" + server
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("DNS 服务器地址无效: %s", server)
+	}
+	upstream := &dnsUpstream{server: server, proto: parsedURL.Scheme, plain: plain}
+	switch parsedURL.Scheme {
+	case "https":
+		upstream.address = parsedURL.String()
+	case "udp", "tcp":
+		upstream.address = withDefaultPort(parsedURL.Host, "53")
+	case "tls":
+		upstream.address = withDefaultPort(parsedURL.Host, "853")
+	default:
+		return nil, fmt.Errorf("DNS 服务器协议 %s 不受支持", parsedURL.Scheme)
+	}
+	return upstream, nil
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func (u *dnsUpstream) String() string {
+	if u.proto == "https" {
+		return u.address
+	}
+	return u.proto + "://" + u.address
+}
+
+// exchangeDNS 依次向上游 DNS 服务器发送查询, 返回第一个成功的响应
+func exchangeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	dnsUpstreamMutex.Lock()
+	upstreams := dnsUpstreams
+	preferred := dnsPreferred
+	dnsUpstreamMutex.Unlock()
+	if len(upstreams) == 0 {
+		return nil, errors.New("未配置 DNS 服务器")
+	}
+
+	var lastErr error
+	for i := range upstreams {
+		index := (preferred + i) % len(upstreams)
+		upstream := upstreams[index]
+		queryCtx, cancel := context.WithTimeout(ctx, dnsUpstreamTimeout)
+		response, err := upstream.exchange(queryCtx, query)
+		cancel()
+		if err == nil {
+			if index != preferred {
+				dnsUpstreamMutex.Lock()
+				// 期间列表可能已被测速结果替换
+				if len(dnsUpstreams) == len(upstreams) && dnsUpstreams[0] == upstreams[0] && dnsPreferred != index {
+					dnsPreferred = index
+					logrus.Infof("DNS 服务器切换至 %s", upstream)
+				}
+				dnsUpstreamMutex.Unlock()
+			}
+			return response, nil
+		}
+		lastErr = err
+		logrus.Debugf("DNS 服务器 %s 查询失败: %v", upstream, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (u *dnsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch u.proto {
+	case "https":
+		return u.exchangeHTTPS(ctx, query)
+	case "udp":
+		response, err := u.exchangeUDP(ctx, query)
+		if err == nil && len(response) > 2 && response[2]&0x02 != 0 {
+			// 响应被截断, 改用 TCP 重新查询
+			return u.exchangeStream(ctx, query, false)
+		}
+		return response, err
+	case "tls":
+		return u.exchangeStream(ctx, query, true)
+	default:
+		return u.exchangeStream(ctx, query, false)
+	}
+}
+
+func (u *dnsUpstream) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := dnsBootstrapDialer.DialContext(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略 ID 不一致的响应
+		if n >= 2 && len(query) >= 2 && buffer[0] == query[0] && buffer[1] == query[1] {
+			return buffer[:n], nil
+		}
+	}
+}
+
+// exchangeStream 通过 TCP 或 TLS 查询, 消息带 2 字节长度前缀
+func (u *dnsUpstream) exchangeStream(ctx context.Context, query []byte, useTLS bool) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(u.address)
+		dialer := &tls.Dialer{NetDialer: dnsBootstrapDialer, Config: &tls.Config{ServerName: host}}
+		conn, err = dialer.DialContext(ctx, "tcp", u.address)
+	} else {
+		conn, err = dnsBootstrapDialer.DialContext(ctx, "tcp", u.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (u *dnsUpstream) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.address, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("statusCode: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize))
+}
+
+// dnsConn 供 net.Resolver 使用的虚拟连接, 收到完整查询后交给 resolveDNS 处理
+// 不实现 net.PacketConn, 因此 net.Resolver 使用带 2 字节长度前缀的流式格式读写
+type dnsConn struct {
+	ctx      context.Context
+	mutex    sync.Mutex
+	deadline time.Time
+	query    bytes.Buffer
+	response bytes.Buffer
+	answered bool
+}
+
+// dialDNS 用作 net.Resolver.Dial, 忽略系统配置的 DNS 服务器地址
+func dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	return &dnsConn{ctx: ctx}, nil
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.query.Write(b)
+	c.answered = false
+	return len(b), nil
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.answered {
+		c.answered = true
+		if err := c.exchangeLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+func (c *dnsConn) exchangeLocked() error {
+	framed := c.query.Bytes()
+	if len(framed) < 2 || len(framed) < 2+int(binary.BigEndian.Uint16(framed)) {
+		return errors.New("DNS 查询不完整")
+	}
+	length := int(binary.BigEndian.Uint16(framed))
+	query := append([]byte(nil), framed[2:2+length]...)
+	c.query.Next(2 + length)
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	response, err := resolveDNS(ctx, query)
+	if err != nil {
+		return err
+	}
+	var prefix [2]byte
+	binary.BigEndian.PutUint16(prefix[:], uint16(len(response)))
+	c.response.Write(prefix[:])
+	c.response.Write(response)
+	return nil
+}
+
+func (c *dnsConn) Close() error {
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr {
+	return dnsConnAddr{}
+}
+
+func (c *dnsConn) RemoteAddr() net.Addr {
+	return dnsConnAddr{}
+}
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *dnsConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type dnsConnAddr struct{}
+
+func (dnsConnAddr) Network() string { return "dns" }
+func (dnsConnAddr) String() string  { return "upstream" }
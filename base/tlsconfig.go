@@ -0,0 +1,253 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// TLSPolicy 为连接源站时的证书策略
+// Pins 为证书 SubjectPublicKeyInfo 的 SHA-256 值(base64, 可带 "sha256/" 前缀)
+// 验证证书时匹配验证通过的证书链中任一证书, 不验证时只匹配源站自身的证书
+// Fingerprint 为模拟的浏览器 TLS 指纹, 见 parseFingerprint, 为空时沿用全局设置
+// Protocol 为优先使用的 HTTP 版本, 见 parseProtocol, 为空时沿用全局设置, 默认 HTTP/1.1
+// HTTP/2 与 HTTP/3 会把同一会话的所有分块请求复用到一个连接上, 需按域名显式开启
+type TLSPolicy struct {
+	Verify      *bool // 为 nil 时沿用全局设置
+	Pins        []string
+	ClientCert  string
+	ClientKey   string
+	Fingerprint string
+	Protocol    string
+}
+
+type tlsPolicy struct {
+	verify      bool
+	pins        [][]byte
+	clientCert  *tls.Certificate
+	fingerprint *utls.ClientHelloID // 为 nil 时使用 Go 默认的握手
+	protocol    string
+}
+
+var (
+	tlsDefaultPolicy  = &tlsPolicy{protocol: protocolHTTP1}
+	tlsDomainPolicies = map[string]*tlsPolicy{} // 键为小写域名, 同时匹配其子域名
+	tlsRootCAs        *x509.CertPool            // 为 nil 时使用系统证书
+	tlsClientCerts    []tls.Certificate         // 所有配置的客户端证书
+)
+
+// ConfigureTLS 设置证书验证策略, 需在 InitClient 之前调用
+// 默认不验证证书, domains 中的设置按域名覆盖全局设置, caFiles 中的证书会追加到系统证书中
+func ConfigureTLS(global TLSPolicy, caFiles []string, domains map[string]TLSPolicy) error {
+	var rootCAs *x509.CertPool
+	if len(caFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range caFiles {
+			data, err := os.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("读取 CA 证书 %s 失败: %v", caFile, err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("CA 证书 %s 中没有有效的证书", caFile)
+			}
+		}
+		rootCAs = pool
+	}
+
+	var clientCerts []tls.Certificate
+	parse := func(policy TLSPolicy, parent *tlsPolicy) (*tlsPolicy, error) {
+		parsed := &tlsPolicy{protocol: protocolHTTP1}
+		if parent != nil {
+			parsed.verify = parent.verify
+			parsed.clientCert = parent.clientCert
+			parsed.fingerprint = parent.fingerprint
+			parsed.protocol = parent.protocol
+		}
+		if policy.Verify != nil {
+			parsed.verify = *policy.Verify
+		}
+		for _, pin := range policy.Pins {
+			hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("证书固定值 %s 无效", pin)
+			}
+			parsed.pins = append(parsed.pins, hash)
+		}
+		if policy.ClientCert != "" || policy.ClientKey != "" {
+			cert, err := tls.LoadX509KeyPair(policy.ClientCert, policy.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("加载客户端证书 %s 失败: %v", policy.ClientCert, err)
+			}
+			parsed.clientCert = &cert
+			clientCerts = append(clientCerts, cert)
+		}
+		if policy.Fingerprint != "" {
+			fingerprint, err := parseFingerprint(policy.Fingerprint)
+			if err != nil {
+				return nil, err
+			}
+			parsed.fingerprint = fingerprint
+		}
+		if policy.Protocol != "" {
+			protocol, err := parseProtocol(policy.Protocol)
+			if err != nil {
+				return nil, err
+			}
+			parsed.protocol = protocol
+		}
+		return parsed, nil
+	}
+
+	defaultPolicy, err := parse(global, nil)
+	if err != nil {
+		return err
+	}
+	domainPolicies := make(map[string]*tlsPolicy, len(domains))
+	for domain, policy := range domains {
+		parsed, err := parse(policy, defaultPolicy)
+		if err != nil {
+			return fmt.Errorf("%s: %v", domain, err)
+		}
+		domainPolicies[strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(domain, "*"), "."))] = parsed
+	}
+
+	tlsDefaultPolicy = defaultPolicy
+	tlsDomainPolicies = domainPolicies
+	tlsRootCAs = rootCAs
+	tlsClientCerts = clientCerts
+	return nil
+}
+
+// tlsPolicyFor 返回域名对应的策略, 匹配最长的已配置域名
+func tlsPolicyFor(host string) *tlsPolicy {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for suffix := host; ; {
+		if policy, found := tlsDomainPolicies[suffix]; found {
+			return policy
+		}
+		index := strings.IndexByte(suffix, '.')
+		if index < 0 {
+			return tlsDefaultPolicy
+		}
+		suffix = suffix[index+1:]
+	}
+}
+
+// verifyTLSConnection 按域名策略验证证书链与固定的公钥
+func verifyTLSConnection(cs tls.ConnectionState) error {
+	return verifyPeerCertificates(cs.ServerName, cs.PeerCertificates)
+}
+
+func verifyPeerCertificates(serverName string, peerCertificates []*x509.Certificate) error {
+	policy := tlsPolicyFor(serverName)
+	if len(peerCertificates) == 0 {
+		if policy.verify || len(policy.pins) > 0 {
+			return errors.New("源站未提供证书")
+		}
+		return nil
+	}
+	// 不验证证书链时无法确认源站附带的其他证书与其自身证书有关, 只匹配源站自身的证书
+	candidates := peerCertificates[:1]
+	if policy.verify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range peerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		chains, err := peerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         tlsRootCAs,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("%s 证书验证失败: %v", serverName, err)
+		}
+		// 源站附带但不在已验证证书链中的证书不参与匹配
+		candidates = nil
+		for _, chain := range chains {
+			candidates = append(candidates, chain...)
+		}
+	}
+	if len(policy.pins) == 0 {
+		return nil
+	}
+	for _, cert := range candidates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range policy.pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s 证书公钥与固定值不符", serverName)
+}
+
+// NewTLSClientConfig 返回连接源站使用的 TLS 配置
+// 证书由 VerifyConnection 按域名策略验证; 此配置无法得知源站域名, 因此提供源站接受的第一个客户端证书
+func NewTLSClientConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   verifyTLSConnection,
+		GetClientCertificate: func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			for i := range tlsClientCerts {
+				if cri.SupportsCertificate(&tlsClientCerts[i]) == nil {
+					return &tlsClientCerts[i], nil
+				}
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+}
+
+// tlsConfigForHost 返回连接 host 时使用的 TLS 配置, 只提供该域名配置的客户端证书
+func tlsConfigForHost(host string, nextProtos []string) *tls.Config {
+	config := NewTLSClientConfig()
+	config.ServerName = host
+	config.NextProtos = nextProtos
+	clientCert := tlsPolicyFor(host).clientCert
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if clientCert == nil {
+			return &tls.Certificate{}, nil
+		}
+		return clientCert, nil
+	}
+	return config
+}
+
+// dialTLS 用 dial 建立连接后按域名选择 TLS 配置与指纹完成握手, nextProtos 为 ALPN 中声明的协议
+func dialTLS(dial func(ctx context.Context, network, address string) (net.Conn, error), nextProtos []string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		rawConn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		if fingerprint := tlsPolicyFor(host).fingerprint; fingerprint != nil {
+			conn, err = handshakeFingerprint(ctx, rawConn, host, *fingerprint, nextProtos)
+		} else {
+			tlsConn := tls.Client(rawConn, tlsConfigForHost(host, nextProtos))
+			conn, err = tlsConn, tlsConn.HandshakeContext(ctx)
+		}
+		if err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
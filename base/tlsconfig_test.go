@@ -0,0 +1,122 @@
+package base
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert 生成证书, parent 为 nil 时生成自签名证书
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		template.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func pinOf(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+func TestVerifyPeerCertificatesPins(t *testing.T) {
+	savedPolicy, savedRootCAs := tlsDefaultPolicy, tlsRootCAs
+	defer func() {
+		tlsDefaultPolicy, tlsRootCAs = savedPolicy, savedRootCAs
+	}()
+
+	const host = "media.example.com"
+	ca, caKey := newTestCert(t, "Test CA", true, nil, nil)
+	leaf, _ := newTestCert(t, host, false, ca, caKey)
+	foreign, _ := newTestCert(t, host, false, nil, nil)
+	other, _ := newTestCert(t, "Other CA", true, nil, nil)
+	tlsRootCAs = x509.NewCertPool()
+	tlsRootCAs.AddCert(ca)
+
+	tests := []struct {
+		name    string
+		verify  bool
+		pin     *x509.Certificate
+		peers   []*x509.Certificate
+		wantErr bool
+	}{
+		{
+			name:  "不验证时匹配源站证书",
+			pin:   leaf,
+			peers: []*x509.Certificate{leaf, ca},
+		},
+		{
+			name:    "不验证时伪造的证书后附带固定的证书",
+			pin:     ca,
+			peers:   []*x509.Certificate{foreign, ca},
+			wantErr: true,
+		},
+		{
+			name:    "不验证时不匹配源站附带的CA证书",
+			pin:     ca,
+			peers:   []*x509.Certificate{leaf, ca},
+			wantErr: true,
+		},
+		{
+			name:   "验证时匹配证书链中的CA证书",
+			verify: true,
+			pin:    ca,
+			peers:  []*x509.Certificate{leaf},
+		},
+		{
+			name:    "验证时伪造的证书后附带固定的证书",
+			verify:  true,
+			pin:     ca,
+			peers:   []*x509.Certificate{foreign, ca},
+			wantErr: true,
+		},
+		{
+			name:    "验证时不匹配证书链以外的证书",
+			verify:  true,
+			pin:     other,
+			peers:   []*x509.Certificate{leaf, other},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsDefaultPolicy = &tlsPolicy{verify: tt.verify, pins: [][]byte{pinOf(tt.pin)}, protocol: protocolHTTP1}
+			err := verifyPeerCertificates(host, tt.peers)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyPeerCertificates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
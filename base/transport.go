@@ -0,0 +1,354 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	utls "github.com/refraction-networking/utls"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	protocolHTTP1 = "http1"
+	protocolHTTP2 = "http2"
+	protocolHTTP3 = "http3"
+
+	protocolFallbackDuration = 10 * time.Minute // 源站不支持某个协议时, 在此期间直接使用下一个协议
+)
+
+var (
+	http1Protos = []string{"http/1.1"}
+	http2Protos = []string{"h2", "http/1.1"}
+
+	errHTTP2NotNegotiated = errors.New("源站不支持 HTTP/2")
+
+	protocolFallbackMutex sync.Mutex
+	protocolFallbacks     = make(map[string]time.Time) // 键为 协议|host:port, 值为恢复尝试的时间
+)
+
+// parseProtocol 解析优先使用的 HTTP 版本, http2 与 http3 在源站不支持时自动回退
+func parseProtocol(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "http1", "http/1.1", "h1":
+		return protocolHTTP1, nil
+	case "http2", "h2":
+		return protocolHTTP2, nil
+	case "http3", "h3":
+		return protocolHTTP3, nil
+	default:
+		return "", fmt.Errorf("HTTP 版本 %s 不受支持, 可选 http1、http2 或 http3", name)
+	}
+}
+
+func protocolDisabled(protocol string, address string) bool {
+	protocolFallbackMutex.Lock()
+	defer protocolFallbackMutex.Unlock()
+	until, found := protocolFallbacks[protocol+"|"+address]
+	if found && time.Now().After(until) {
+		delete(protocolFallbacks, protocol+"|"+address)
+		return false
+	}
+	return found
+}
+
+func disableProtocol(protocol string, address string, err error) {
+	protocolFallbackMutex.Lock()
+	defer protocolFallbackMutex.Unlock()
+	if _, found := protocolFallbacks[protocol+"|"+address]; !found {
+		logrus.Debugf("%s 暂不使用 %s, %v 后重试: %v", address, protocol, protocolFallbackDuration, err)
+	}
+	protocolFallbacks[protocol+"|"+address] = time.Now().Add(protocolFallbackDuration)
+}
+
+// negotiatedProtocol 返回 TLS 连接通过 ALPN 协商的协议
+func negotiatedProtocol(conn net.Conn) string {
+	switch conn := conn.(type) {
+	case *tls.Conn:
+		return conn.ConnectionState().NegotiatedProtocol
+	case *utls.UConn:
+		return conn.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+// upstreamTransport 按域名选择 HTTP 版本, 并自行处理经上游代理访问 HTTPS 源站的请求
+// HTTP/2 与 HTTP/3 在源站不支持时回退到 HTTP/1.1; HTTP/3 基于 UDP, 只用于直连的请求, 也不模拟 TLS 指纹
+// http.Transport 经代理建立隧道后总是使用 crypto/tls 握手, 因此 HTTPS 请求交给按代理区分的 Transport,
+// 由其自行建立隧道后再按域名设置握手, 同时保证不同代理的连接不会相互复用
+// 关闭了 Keep-Alive 的客户端(对冲请求)每次都需要新连接, 始终使用 HTTP/1.1
+type upstreamTransport struct {
+	*http.Transport
+	http3  *http3.RoundTripper
+	mutex  sync.Mutex
+	routes map[string]*upstreamRoute // 键为代理地址, 直连为空字符串
+}
+
+// upstreamRoute 为经同一代理(或直连)访问源站时使用的各版本 Transport
+type upstreamRoute struct {
+	http1 *http.Transport
+	http2 *http2.Transport
+}
+
+func newUpstreamTransport(transport *http.Transport, resolver *net.Resolver) *upstreamTransport {
+	return &upstreamTransport{
+		Transport: transport,
+		http3: &http3.RoundTripper{
+			TLSClientConfig: NewTLSClientConfig(),
+			Dial:            dialQUIC(resolver),
+		},
+		routes: make(map[string]*upstreamRoute),
+	}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.Transport.RoundTrip(req)
+	}
+	var proxyURL *url.URL
+	if t.Proxy != nil {
+		var err error
+		if proxyURL, err = t.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+	route := t.route(proxyURL)
+	protocol := tlsPolicyFor(req.URL.Hostname()).protocol
+	if t.DisableKeepAlives {
+		protocol = protocolHTTP1
+	}
+	address := canonicalAddress(req.URL)
+	// 已发送的请求体无法重放时不回退
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	if protocol == protocolHTTP3 && proxyURL == nil && !protocolDisabled(protocolHTTP3, address) {
+		resp, err := t.http3.RoundTrip(req)
+		if err == nil || req.Context().Err() != nil || !replayable {
+			return resp, err
+		}
+		disableProtocol(protocolHTTP3, address, err)
+		if req, err = rewindRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	if protocol != protocolHTTP1 && !protocolDisabled(protocolHTTP2, address) {
+		resp, err := route.http2.RoundTrip(req)
+		if !errors.Is(err, errHTTP2NotNegotiated) {
+			return resp, err
+		}
+		if req, err = rewindRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	return route.http1.RoundTrip(req)
+}
+
+// route 返回经 proxyURL 访问源站的 Transport, 其余设置与原 Transport 相同
+func (t *upstreamTransport) route(proxyURL *url.URL) *upstreamRoute {
+	key := ""
+	if proxyURL != nil {
+		key = proxyURL.String()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if route, found := t.routes[key]; found {
+		return route
+	}
+	dial := contextDialer(t.Transport.DialContext)
+	route := &upstreamRoute{http1: t.Transport}
+	if proxyURL != nil {
+		baseDial := dial
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialTunnel(ctx, baseDial, proxyURL, address)
+		}
+		route.http1 = t.Transport.Clone()
+		route.http1.Proxy = nil
+		route.http1.DialTLSContext = dialTLS(dial, http1Protos)
+	}
+	dialHTTP2 := dialTLS(dial, http2Protos)
+	route.http2 = &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, address string, _ *tls.Config) (net.Conn, error) {
+			conn, err := dialHTTP2(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if negotiatedProtocol(conn) != "h2" {
+				conn.Close()
+				disableProtocol(protocolHTTP2, address, errHTTP2NotNegotiated)
+				return nil, errHTTP2NotNegotiated
+			}
+			return conn, nil
+		},
+		IdleConnTimeout: t.Transport.IdleConnTimeout,
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+	t.routes[key] = route
+	return route
+}
+
+// CloseIdleConnections 同时关闭各版本 Transport 的空闲连接
+func (t *upstreamTransport) CloseIdleConnections() {
+	t.Transport.CloseIdleConnections()
+	t.http3.CloseIdleConnections()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, route := range t.routes {
+		route.http1.CloseIdleConnections()
+		route.http2.CloseIdleConnections()
+	}
+}
+
+func canonicalAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// rewindRequest 返回可以重新发送的请求副本
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	rewound := req.Clone(req.Context())
+	rewound.Body = body
+	return rewound, nil
+}
+
+// dialQUIC 用作 http3.RoundTripper.Dial, 通过 resolver 解析域名后依次尝试各 IP
+func dialQUIC(resolver *net.Resolver) func(ctx context.Context, address string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyConnection, error) {
+	return func(ctx context.Context, address string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyConnection, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips := []net.IPAddr{{IP: net.ParseIP(host)}}
+		if ips[0].IP == nil {
+			if ips, err = resolver.LookupIPAddr(ctx, host); err != nil {
+				return nil, err
+			}
+		}
+		config := tlsConfigForHost(host, tlsConfig.NextProtos)
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(ip.String(), port), config, quicConfig)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+type contextDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// dialTunnel 经上游代理连接 address, 支持 http、https、socks5 与 socks5h 代理
+func dialTunnel(ctx context.Context, dial contextDialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, dial)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("上游代理协议 %s 不受支持", proxyURL.Scheme)
+	}
+
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddress = canonicalAddress(proxyURL)
+	}
+	conn, err := dial(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, tlsConfigForHost(proxyURL.Hostname(), http1Protos))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// 握手期间 ctx 被取消时中断读写
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("上游代理 %s 建立隧道失败: %s", proxyURL.Redacted(), resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("上游代理 %s 在隧道建立前发送了多余数据", proxyURL.Redacted())
+	}
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
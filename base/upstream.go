@@ -0,0 +1,325 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DirectProxy 表示不经过上游代理直接连接源站
+const DirectProxy = "direct"
+
+// UpstreamProxyRule 将匹配的域名或 URL 指定给上游代理
+// Match 为域名时匹配该域名及其子域名, 以 "regexp:" 开头时按正则表达式匹配完整 URL, "*" 匹配所有请求
+type UpstreamProxyRule struct {
+	Match string
+	Proxy string
+}
+
+// UpstreamProxyPool 由多个上游代理组成的代理池, 规则可以像代理一样指定代理池名称
+// Strategy 为 roundRobin(默认) 或 leastLoaded, 成员可以包含 direct
+type UpstreamProxyPool struct {
+	Proxies  []string
+	Strategy string
+}
+
+const (
+	poolRoundRobin  = "roundRobin"
+	poolLeastLoaded = "leastLoaded"
+
+	poolMaxFailures      = 3                // 连续失败多少次后暂停使用该代理
+	poolEjectDuration    = 30 * time.Second // 首次暂停时长, 再次暂停时加倍
+	poolMaxEjectDuration = 5 * time.Minute
+)
+
+type proxyPool struct {
+	mutex    sync.Mutex
+	name     string
+	strategy string
+	members  []*proxyPoolMember
+	next     int
+}
+
+type proxyPoolMember struct {
+	pool          *proxyPool
+	name          string
+	url           *url.URL // 为 nil 时直接连接
+	active        int      // 正在使用该代理的请求数
+	failures      int      // 连续失败次数
+	ejectCount    int      // 连续暂停次数, 用于计算暂停时长
+	ejectedUntil  time.Time
+	totalRequests int64
+	totalFailures int64
+}
+
+type upstreamProxyKey struct{}
+
+type upstreamRule struct {
+	domain  string
+	pattern *regexp.Regexp
+	proxy   string
+}
+
+var (
+	upstreamProxies     = map[string]*url.URL{}
+	upstreamPools       = map[string]*proxyPool{}
+	upstreamRules       []upstreamRule
+	defaultUpstreamName = DirectProxy
+)
+
+// ConfigureUpstreamProxies 设置上游代理及其匹配规则, 需在处理请求前调用
+// proxies 为代理名称到代理地址的映射, 支持 http、https、socks5 与 socks5h, 认证信息写在地址中
+func ConfigureUpstreamProxies(proxies map[string]string, pools map[string]UpstreamProxyPool, rules []UpstreamProxyRule, defaultProxy string) error {
+	parsedProxies := make(map[string]*url.URL, len(proxies))
+	for name, rawURL := range proxies {
+		if name == DirectProxy {
+			return fmt.Errorf("代理名称 %s 为保留名称", name)
+		}
+		proxyURL, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("代理 %s 地址无效: %v", name, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("代理 %s 协议 %s 不受支持", name, proxyURL.Scheme)
+		}
+		if proxyURL.Host == "" {
+			return fmt.Errorf("代理 %s 缺少主机地址", name)
+		}
+		parsedProxies[name] = proxyURL
+	}
+
+	parsedPools := make(map[string]*proxyPool, len(pools))
+	for name, pool := range pools {
+		if _, found := parsedProxies[name]; found || name == DirectProxy {
+			return fmt.Errorf("代理池名称 %s 与代理名称重复", name)
+		}
+		if len(pool.Proxies) == 0 {
+			return fmt.Errorf("代理池 %s 为空", name)
+		}
+		strategy := pool.Strategy
+		switch strategy {
+		case "":
+			strategy = poolRoundRobin
+		case poolRoundRobin, poolLeastLoaded:
+		default:
+			return fmt.Errorf("代理池 %s 的策略 %s 不受支持", name, strategy)
+		}
+		parsedPool := &proxyPool{name: name, strategy: strategy}
+		for _, member := range pool.Proxies {
+			proxyURL, found := parsedProxies[member]
+			if !found && member != DirectProxy {
+				return fmt.Errorf("代理池 %s 包含未定义的代理: %s", name, member)
+			}
+			parsedPool.members = append(parsedPool.members, &proxyPoolMember{pool: parsedPool, name: member, url: proxyURL})
+		}
+		parsedPools[name] = parsedPool
+	}
+
+	checkName := func(name string) error {
+		if _, found := parsedPools[name]; found {
+			return nil
+		}
+		if _, found := parsedProxies[name]; !found && name != DirectProxy {
+			return fmt.Errorf("未定义的代理: %s", name)
+		}
+		return nil
+	}
+	if defaultProxy == "" {
+		defaultProxy = DirectProxy
+	}
+	if err := checkName(defaultProxy); err != nil {
+		return err
+	}
+
+	parsedRules := make([]upstreamRule, 0, len(rules))
+	for _, rule := range rules {
+		if err := checkName(rule.Proxy); err != nil {
+			return err
+		}
+		parsedRule := upstreamRule{proxy: rule.Proxy}
+		if expr, found := strings.CutPrefix(rule.Match, "regexp:"); found {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("代理规则 %s 无效: %v", rule.Match, err)
+			}
+			parsedRule.pattern = pattern
+		} else {
+			parsedRule.domain = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(rule.Match, "*"), "."))
+		}
+		parsedRules = append(parsedRules, parsedRule)
+	}
+
+	upstreamProxies = parsedProxies
+	upstreamPools = parsedPools
+	upstreamRules = parsedRules
+	defaultUpstreamName = defaultProxy
+	return nil
+}
+
+func (r *upstreamRule) matches(u *url.URL) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(u.String())
+	}
+	if r.domain == "" {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+// UpstreamProxyName 返回访问 u 时使用的上游代理名称, 按规则顺序取第一个匹配项
+func UpstreamProxyName(u *url.URL) string {
+	for i := range upstreamRules {
+		if upstreamRules[i].matches(u) {
+			return upstreamRules[i].proxy
+		}
+	}
+	return defaultUpstreamName
+}
+
+// UpstreamProxy 用作 http.Transport.Proxy, 根据规则为每个请求选择上游代理, 重定向后的请求也会重新匹配
+// 请求的 context 中已由 AcquireUpstreamProxy 分配代理池成员时使用该成员
+func UpstreamProxy(req *http.Request) (*url.URL, error) {
+	name := UpstreamProxyName(req.URL)
+	var proxyURL *url.URL
+	if pool, found := upstreamPools[name]; found {
+		member, ok := req.Context().Value(upstreamProxyKey{}).(*proxyPoolMember)
+		if !ok || member.pool != pool {
+			member = pool.pick()
+		}
+		name, proxyURL = pool.name+"/"+member.name, member.url
+	} else {
+		proxyURL = upstreamProxies[name]
+	}
+	if proxyURL == nil {
+		return nil, nil
+	}
+	logrus.Debugf("通过上游代理 %s(%s) 访问 %s", name, proxyURL.Redacted(), req.URL.Host)
+	return proxyURL, nil
+}
+
+// AcquireUpstreamProxy 为一次分块请求从代理池中分配代理, 使同一会话的分块分散到不同代理
+// 返回的 release 需在请求结束后调用, failed 表示连接代理或经代理连接源站失败
+// 访问 u 不使用代理池时原样返回 ctx
+func AcquireUpstreamProxy(ctx context.Context, u string) (context.Context, func(failed bool)) {
+	parsedURL, err := url.Parse(u)
+	if err != nil {
+		return ctx, func(bool) {}
+	}
+	pool, found := upstreamPools[UpstreamProxyName(parsedURL)]
+	if !found {
+		return ctx, func(bool) {}
+	}
+	member := pool.acquire()
+	return context.WithValue(ctx, upstreamProxyKey{}, member), func(failed bool) {
+		pool.release(member, failed)
+	}
+}
+
+// pick 按策略选择一个可用成员, 所有成员都被暂停时选择最早恢复的成员
+func (pool *proxyPool) pick() *proxyPoolMember {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.pickLocked()
+}
+
+func (pool *proxyPool) pickLocked() *proxyPoolMember {
+	now := time.Now()
+	picked := -1
+	for i := range pool.members {
+		index := (pool.next + i) % len(pool.members)
+		if pool.members[index].ejectedUntil.After(now) {
+			continue
+		}
+		if picked < 0 || (pool.strategy == poolLeastLoaded && pool.members[index].active < pool.members[picked].active) {
+			picked = index
+		}
+		if pool.strategy == poolRoundRobin {
+			break
+		}
+	}
+	if picked < 0 {
+		for index, member := range pool.members {
+			if picked < 0 || member.ejectedUntil.Before(pool.members[picked].ejectedUntil) {
+				picked = index
+			}
+		}
+	}
+	pool.next = (picked + 1) % len(pool.members)
+	return pool.members[picked]
+}
+
+func (pool *proxyPool) acquire() *proxyPoolMember {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	member := pool.pickLocked()
+	member.active++
+	member.totalRequests++
+	return member
+}
+
+func (pool *proxyPool) release(member *proxyPoolMember, failed bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	member.active--
+	if !failed {
+		if member.ejectCount > 0 {
+			logrus.Infof("代理池 %s 的代理 %s 已恢复", pool.name, member.name)
+		}
+		member.failures = 0
+		member.ejectCount = 0
+		member.ejectedUntil = time.Time{}
+		return
+	}
+	member.totalFailures++
+	member.failures++
+	if member.failures < poolMaxFailures {
+		return
+	}
+	duration := poolMaxEjectDuration
+	if member.ejectCount < 4 {
+		duration = min(poolEjectDuration<<member.ejectCount, poolMaxEjectDuration)
+	}
+	member.ejectCount++
+	member.failures = 0
+	member.ejectedUntil = time.Now().Add(duration)
+	logrus.Warnf("代理池 %s 的代理 %s 连续失败 %d 次, 暂停使用 %v", pool.name, member.name, poolMaxFailures, duration)
+	pool.logHealthLocked()
+}
+
+// logHealthLocked 输出代理池各成员的状态, 调用方需持有锁
+func (pool *proxyPool) logHealthLocked() {
+	now := time.Now()
+	var status []string
+	for _, member := range pool.members {
+		state := "可用"
+		if member.ejectedUntil.After(now) {
+			state = fmt.Sprintf("暂停 %v", member.ejectedUntil.Sub(now).Round(time.Second))
+		}
+		status = append(status, fmt.Sprintf("%s[%s, 进行中 %d, 请求 %d, 失败 %d]", member.name, state, member.active, member.totalRequests, member.totalFailures))
+	}
+	logrus.Infof("代理池 %s 状态: %s", pool.name, strings.Join(status, ", "))
+}
+
+// LogUpstreamProxyHealth 定期输出所有代理池的状态, 未配置代理池时直接返回
+func LogUpstreamProxyHealth(interval time.Duration) {
+	if len(upstreamPools) == 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		for _, pool := range upstreamPools {
+			pool.mutex.Lock()
+			pool.logHealthLocked()
+			pool.mutex.Unlock()
+		}
+	}
+}
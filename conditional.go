@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+
+	"MediaProxy/base"
+
+	"github.com/sirupsen/logrus"
+)
+
+// notModified 按 If-None-Match 或 If-Modified-Since 判断客户端缓存的内容是否仍然有效
+// 同时存在时只使用 If-None-Match, ETag 按弱比较
+func notModified(req *http.Request, header http.Header) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// writeNotModified 返回 304, 只保留与缓存相关的响应头
+func writeNotModified(w http.ResponseWriter, header http.Header) {
+	for _, key := range []string{"ETag", "Last-Modified", "Cache-Control", "Expires", "Vary", "Content-Location"} {
+		if value := header.Get(key); value != "" {
+			w.Header().Set(key, value)
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// revalidateHeaders 向源站确认缓存的响应头是否仍然有效
+// 带上 If-None-Match、If-Modified-Since 请求第一个字节, 源站返回 304 或相同的 ETag、Last-Modified 与文件大小时视为有效
+// 源站暂时无法访问时继续使用缓存
+func revalidateHeaders(req *http.Request, url string, newHeader map[string][]string, jar *cookiejar.Jar, cached http.Header) bool {
+	request := base.SessionClient(base.RestyClientWithProxy, jar, 0, 3).
+		R().
+		SetContext(req.Context()).
+		SetDoNotParseResponse(true).
+		SetHeaderMultiValues(newHeader).
+		SetHeader("Range", "bytes=0-0")
+	if etag := cached.Get("ETag"); etag != "" {
+		request.SetHeader("If-None-Match", etag)
+	}
+	if lastModified := cached.Get("Last-Modified"); lastModified != "" {
+		request.SetHeader("If-Modified-Since", lastModified)
+	}
+	resp, err := request.Get(url)
+	if err != nil {
+		logrus.Debugf("重新验证 %v 失败, 继续使用缓存的 Headers: %v", url, err)
+		return true
+	}
+	defer resp.RawBody().Close()
+
+	switch {
+	case resp.StatusCode() == http.StatusNotModified:
+		return true
+	case resp.StatusCode() >= 500:
+		logrus.Debugf("重新验证 %v 失败, 继续使用缓存的 Headers, statusCode: %d", url, resp.StatusCode())
+		return true
+	case resp.StatusCode() < 200 || resp.StatusCode() >= 300:
+		return false
+	}
+	header := resp.Header()
+	size := contentRangeSize(header.Get("Content-Range"))
+	if size < 0 {
+		size = resp.RawResponse.ContentLength
+	}
+	cachedSize, _ := strconv.ParseInt(cached.Get("Content-Length"), 10, 64)
+	return header.Get("ETag") == cached.Get("ETag") &&
+		header.Get("Last-Modified") == cached.Get("Last-Modified") &&
+		(size < 0 || size == cachedSize)
+}
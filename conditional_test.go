@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"MediaProxy/base"
+)
+
+func TestNotModified(t *testing.T) {
+	header := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Tue, 14 Nov 2023 22:13:20 GMT"},
+	}
+	tests := []struct {
+		name            string
+		ifNoneMatch     string
+		ifModifiedSince string
+		header          http.Header
+		want            bool
+	}{
+		{
+			name:        "ETag 一致",
+			ifNoneMatch: `"v1"`,
+			header:      header,
+			want:        true,
+		},
+		{
+			name:        "ETag 不一致",
+			ifNoneMatch: `"v2"`,
+			header:      header,
+		},
+		{
+			name:        "列表中任一 ETag 一致",
+			ifNoneMatch: `"v0", "v1"`,
+			header:      header,
+			want:        true,
+		},
+		{
+			name:        "星号匹配任意 ETag",
+			ifNoneMatch: "*",
+			header:      header,
+			want:        true,
+		},
+		{
+			name:        "星号在源站没有 ETag 时不匹配",
+			ifNoneMatch: "*",
+			header:      http.Header{"Last-Modified": {"Tue, 14 Nov 2023 22:13:20 GMT"}},
+		},
+		{
+			name:        "客户端的弱 ETag 按弱比较一致",
+			ifNoneMatch: `W/"v1"`,
+			header:      header,
+			want:        true,
+		},
+		{
+			name:        "源站的弱 ETag 按弱比较一致",
+			ifNoneMatch: `"v1"`,
+			header:      http.Header{"Etag": {`W/"v1"`}},
+			want:        true,
+		},
+		{
+			name:            "If-None-Match 不一致时忽略 If-Modified-Since",
+			ifNoneMatch:     `"v2"`,
+			ifModifiedSince: "Tue, 14 Nov 2023 22:13:20 GMT",
+			header:          header,
+		},
+		{
+			name:            "If-None-Match 一致时忽略 If-Modified-Since",
+			ifNoneMatch:     `"v1"`,
+			ifModifiedSince: "Mon, 13 Nov 2023 00:00:00 GMT",
+			header:          header,
+			want:            true,
+		},
+		{
+			name:            "Last-Modified 不晚于 If-Modified-Since",
+			ifModifiedSince: "Tue, 14 Nov 2023 22:13:20 GMT",
+			header:          header,
+			want:            true,
+		},
+		{
+			name:            "Last-Modified 晚于 If-Modified-Since",
+			ifModifiedSince: "Mon, 13 Nov 2023 00:00:00 GMT",
+			header:          header,
+		},
+		{
+			name:            "无效的日期被忽略",
+			ifModifiedSince: "yesterday",
+			header:          header,
+		},
+		{
+			name:            "源站的 Last-Modified 无效",
+			ifModifiedSince: "Tue, 14 Nov 2023 22:13:20 GMT",
+			header:          http.Header{"Last-Modified": {"yesterday"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.ifModifiedSince != "" {
+				req.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			if got := notModified(req, tt.header); got != tt.want {
+				t.Errorf("notModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevalidateHeaders(t *testing.T) {
+	base.InitClient()
+	cached := http.Header{
+		"Etag":           {`"v1"`},
+		"Last-Modified":  {"Tue, 14 Nov 2023 22:13:20 GMT"},
+		"Content-Length": {"1000"},
+	}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    bool
+	}{
+		{
+			name: "源站返回 304",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") != `"v1"` || r.Header.Get("If-Modified-Since") != "Tue, 14 Nov 2023 22:13:20 GMT" {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.WriteHeader(http.StatusNotModified)
+			},
+			want: true,
+		},
+		{
+			name: "源站文件未变化",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Last-Modified", "Tue, 14 Nov 2023 22:13:20 GMT")
+				w.Header().Set("Content-Range", "bytes 0-0/1000")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("0"))
+			},
+			want: true,
+		},
+		{
+			name: "ETag 已变化",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v2"`)
+				w.Header().Set("Last-Modified", "Tue, 14 Nov 2023 22:13:20 GMT")
+				w.Header().Set("Content-Range", "bytes 0-0/1000")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("0"))
+			},
+		},
+		{
+			name: "文件大小已变化",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Last-Modified", "Tue, 14 Nov 2023 22:13:20 GMT")
+				w.Header().Set("Content-Range", "bytes 0-0/2000")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("0"))
+			},
+		},
+		{
+			name: "源站返回 404",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+		},
+		{
+			name: "源站暂时无法访问时继续使用缓存",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(tt.handler)
+			defer upstream.Close()
+			jar, _ := cookiejar.New(nil)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if got := revalidateHeaders(req, upstream.URL+"/data.bin", nil, jar, cached); got != tt.want {
+				t.Errorf("revalidateHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	handleUrl "net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	dashURLAttrRegex  = regexp.MustCompile(`\s(media|initialization|index|sourceURL)\s*=\s*("[^"]*"|'[^']*')`)
+	dashTemplateRegex = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time|SubNumber)?(%0[0-9]+[dioxX])?\$`)
+)
+
+// 各元素中需要改写的地址属性
+var dashURLAttrs = map[string][]string{
+	"SegmentTemplate":     {"media", "initialization", "index"},
+	"SegmentURL":          {"media", "index"},
+	"Initialization":      {"sourceURL"},
+	"RepresentationIndex": {"sourceURL"},
+}
+
+// dashEdit 表示对清单原文 [start, end) 区间的一次替换, start 与 end 相等时为插入
+type dashEdit struct {
+	start int64
+	end   int64
+	text  string
+}
+
+// dashNode 为清单中的一个元素及其在原文中的位置
+type dashNode struct {
+	element    xml.StartElement
+	parent     *dashNode
+	children   []*dashNode
+	tagStart   int64 // 起始标签位于 [tagStart, tagEnd)
+	tagEnd     int64
+	endStart   int64 // 结束标签位于 [endStart, endEnd), 自闭合元素两者均等于 tagEnd
+	endEnd     int64
+	text       strings.Builder // BaseURL、Location 的文本
+	textStart  int64
+	textEnd    int64
+	baseURL    *handleUrl.URL // 该元素生效的 BaseURL
+	hasBaseURL bool           // 该元素或其上层是否设置了 BaseURL
+}
+
+func (n *dashNode) child(name string) *dashNode {
+	for _, c := range n.children {
+		if c.element.Name.Local == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// hasSegmentInfo 判断 Representation 是否由自身或上层的 SegmentTemplate、SegmentList 给出分片地址
+// 否则其 BaseURL 即为媒体文件地址
+func (n *dashNode) hasSegmentInfo() bool {
+	for level := n; level != nil; level = level.parent {
+		if level.child("SegmentTemplate") != nil || level.child("SegmentList") != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isDASHManifest 根据 Content-Type 或扩展名判断是否为 DASH 清单
+func isDASHManifest(url string, contentType string) bool {
+	if strings.Contains(strings.ToLower(contentType), "dash+xml") {
+		return true
+	}
+	parsedURL, err := handleUrl.Parse(url)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(parsedURL.Path), ".mpd")
+}
+
+func escapeXMLText(text string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(text))
+	return buf.String()
+}
+
+// dashTemplateLink 生成保留 $Number$、$Time$ 等标识符的代理链接
+// 标识符需由播放器替换, 因此模板链接的 url 不使用 base64 编码, header 的编码方式不变
+func dashTemplateLink(baseURL *handleUrl.URL, template string, lp *proxyLinkParams) (string, bool) {
+	var identifiers []string
+	placeholder := func(i int) string {
+		return fmt.Sprintf("MEDIAPROXYTEMPLATE%dX", i)
+	}
+	ref := dashTemplateRegex.ReplaceAllStringFunc(template, func(identifier string) string {
+		identifiers = append(identifiers, identifier)
+		return placeholder(len(identifiers) - 1)
+	})
+	absURL, ok := resolveMediaURL(baseURL, ref)
+	if !ok {
+		return "", false
+	}
+	if len(identifiers) == 0 {
+		return lp.link(absURL), true
+	}
+	link := lp.template().link(absURL)
+	for i, identifier := range identifiers {
+		link = strings.Replace(link, placeholder(i), identifier, 1)
+	}
+	return link, true
+}
+
+// rewriteDASHTag 改写单个起始标签中的地址属性
+func rewriteDASHTag(tag string, element xml.StartElement, baseURL *handleUrl.URL, lp *proxyLinkParams) string {
+	attrs := make(map[string]string)
+	for _, attr := range element.Attr {
+		attrs[attr.Name.Local] = attr.Value
+	}
+	names := dashURLAttrs[element.Name.Local]
+	return dashURLAttrRegex.ReplaceAllStringFunc(tag, func(raw string) string {
+		match := dashURLAttrRegex.FindStringSubmatch(raw)
+		name := match[1]
+		value, found := attrs[name]
+		if !found {
+			return raw
+		}
+		for _, allowed := range names {
+			if allowed != name {
+				continue
+			}
+			link, ok := dashTemplateLink(baseURL, value, lp)
+			if !ok {
+				return raw
+			}
+			return raw[:len(raw)-len(match[2])] + `"` + escapeXMLText(link) + `"`
+		}
+		return raw
+	})
+}
+
+// appendDASHAttrs 在起始标签末尾追加属性
+func appendDASHAttrs(tag string, attrs string) string {
+	index := strings.LastIndex(tag, "/>")
+	if index < 0 || strings.TrimSpace(tag[index:]) != "/>" {
+		index = strings.LastIndex(tag, ">")
+	}
+	return tag[:index] + attrs + tag[index:]
+}
+
+// inheritedTemplateLinks 返回 Representation 从上层 SegmentTemplate 继承的地址属性
+// 只返回上层与 Representation 生效的 BaseURL 不同, 需要按 Representation 的 BaseURL 重新解析的属性
+func inheritedTemplateLinks(rep *dashNode, lp *proxyLinkParams) string {
+	defined := make(map[string]bool)
+	if own := rep.child("SegmentTemplate"); own != nil {
+		for _, attr := range own.element.Attr {
+			defined[attr.Name.Local] = true
+		}
+	}
+	inherited := make(map[string]string)
+	for level := rep.parent; level != nil; level = level.parent {
+		template := level.child("SegmentTemplate")
+		if template == nil {
+			continue
+		}
+		for _, attr := range template.element.Attr {
+			if defined[attr.Name.Local] {
+				continue
+			}
+			defined[attr.Name.Local] = true
+			if level.baseURL.String() != rep.baseURL.String() {
+				inherited[attr.Name.Local] = attr.Value
+			}
+		}
+	}
+
+	var attrs strings.Builder
+	for _, name := range dashURLAttrs["SegmentTemplate"] {
+		value, found := inherited[name]
+		if !found {
+			continue
+		}
+		if link, ok := dashTemplateLink(rep.baseURL, value, lp); ok {
+			attrs.WriteString(" " + name + `="` + escapeXMLText(link) + `"`)
+		}
+	}
+	return attrs.String()
+}
+
+// parseDASHNodes 解析清单, 返回记录了原文位置的元素树
+func parseDASHNodes(manifest []byte) (*dashNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(manifest))
+	root := &dashNode{}
+	current := root
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := decoder.InputOffset()
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &dashNode{element: t.Copy(), parent: current, tagStart: start, tagEnd: end, textStart: end, textEnd: end}
+			current.children = append(current.children, node)
+			current = node
+		case xml.CharData:
+			if name := current.element.Name.Local; name == "BaseURL" || name == "Location" {
+				current.text.Write(t)
+				current.textEnd = end
+			}
+		case xml.EndElement:
+			current.endStart, current.endEnd = start, end
+			current = current.parent
+		}
+	}
+	return root, nil
+}
+
+// rewriteDASHManifest 将清单中的 SegmentTemplate、SegmentList 等分片地址改写为代理链接
+// 相对地址按 MPD/Period/AdaptationSet/Representation 各层的 BaseURL 逐级解析
+// 分片地址改写为绝对链接后 BaseURL 不再需要, 因此删除; 仅当 BaseURL 本身就是媒体文件地址时改写为代理链接
+// 上层的 SegmentTemplate 在 Representation 有自己的 BaseURL 时, 在 Representation 中补充按其 BaseURL 解析的地址属性
+func rewriteDASHManifest(manifest []byte, manifestURL *handleUrl.URL, lp *proxyLinkParams) ([]byte, error) {
+	root, err := parseDASHNodes(manifest)
+	if err != nil {
+		return nil, err
+	}
+	root.baseURL = manifestURL
+
+	var edits []dashEdit
+	var walk func(n *dashNode)
+	walk = func(n *dashNode) {
+		if n.parent != nil {
+			n.baseURL, n.hasBaseURL = n.parent.baseURL, n.parent.hasBaseURL
+			// 同一层存在多个 BaseURL 时以第一个为准
+			if baseURL := n.child("BaseURL"); baseURL != nil {
+				if absURL, ok := resolveMediaURL(n.baseURL, strings.TrimSpace(baseURL.text.String())); ok {
+					n.baseURL, _ = handleUrl.Parse(absURL)
+					n.hasBaseURL = true
+				}
+			}
+		}
+
+		tag := string(manifest[n.tagStart:n.tagEnd])
+		switch n.element.Name.Local {
+		case "SegmentTemplate", "SegmentURL", "Initialization", "RepresentationIndex":
+			newTag := rewriteDASHTag(tag, n.element, n.parent.baseURL, lp)
+			if n.element.Name.Local == "SegmentTemplate" && n.parent.element.Name.Local == "Representation" {
+				newTag = appendDASHAttrs(newTag, inheritedTemplateLinks(n.parent, lp))
+			}
+			if newTag != tag {
+				edits = append(edits, dashEdit{start: n.tagStart, end: n.tagEnd, text: newTag})
+			}
+		case "Representation":
+			var prefix, suffix string
+			if attrs := inheritedTemplateLinks(n, lp); attrs != "" && n.child("SegmentTemplate") == nil {
+				suffix = "<" + dashQualifiedName(tag, "SegmentTemplate") + attrs + "/>"
+			}
+			if n.hasBaseURL && n.child("BaseURL") == nil && !n.hasSegmentInfo() {
+				if absURL, ok := resolveMediaURL(n.baseURL, ""); ok {
+					name := dashQualifiedName(tag, "BaseURL")
+					prefix = "<" + name + ">" + escapeXMLText(lp.link(absURL)) + "</" + name + ">"
+				}
+			}
+			if prefix == "" && suffix == "" {
+				break
+			}
+			if n.endStart == n.endEnd {
+				// 自闭合的 Representation 改为带子元素的形式
+				closeIndex := int64(strings.LastIndex(tag, "/>"))
+				edits = append(edits, dashEdit{start: n.tagStart + closeIndex, end: n.tagEnd, text: ">" + prefix + suffix + "</" + dashQualifiedName(tag, "Representation") + ">"})
+			} else {
+				edits = append(edits, dashEdit{start: n.tagEnd, end: n.tagEnd, text: prefix})
+				edits = append(edits, dashEdit{start: n.endStart, end: n.endStart, text: suffix})
+			}
+		case "BaseURL":
+			if n.parent.element.Name.Local != "Representation" || n.parent.hasSegmentInfo() {
+				edits = append(edits, dashEdit{start: n.tagStart, end: n.endEnd})
+				break
+			}
+			if absURL, ok := resolveMediaURL(n.parent.parent.baseURL, strings.TrimSpace(n.text.String())); ok {
+				edits = append(edits, dashEdit{start: n.textStart, end: n.textEnd, text: escapeXMLText(lp.link(absURL))})
+			}
+		case "Location":
+			if absURL, ok := resolveMediaURL(n.parent.baseURL, strings.TrimSpace(n.text.String())); ok {
+				edits = append(edits, dashEdit{start: n.textStart, end: n.textEnd, text: escapeXMLText(lp.link(absURL))})
+			}
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	// 同一位置的插入排在替换之前
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].end-edits[i].start < edits[j].end-edits[j].start
+	})
+	var buf bytes.Buffer
+	offset := int64(0)
+	for _, edit := range edits {
+		if edit.start < offset {
+			continue
+		}
+		buf.Write(manifest[offset:edit.start])
+		buf.WriteString(edit.text)
+		offset = edit.end
+	}
+	buf.Write(manifest[offset:])
+	return buf.Bytes(), nil
+}
+
+// dashQualifiedName 返回与 tag 使用相同命名空间前缀的元素名
+func dashQualifiedName(tag string, local string) string {
+	name := strings.TrimPrefix(tag, "<")
+	if index := strings.IndexAny(name, " \t\r\n/>"); index >= 0 {
+		name = name[:index]
+	}
+	if prefix, _, found := strings.Cut(name, ":"); found {
+		return prefix + ":" + local
+	}
+	return local
+}
+
+// handleDASHManifest 下载完整 MPD 清单并改写后返回给客户端
+func handleDASHManifest(w http.ResponseWriter, req *http.Request, url string, newHeader map[string][]string, jar *cookiejar.Jar) {
+	resp := fetchManifest(w, url, newHeader, jar)
+	if resp == nil {
+		return
+	}
+
+	// 以重定向后的最终地址作为相对路径的基准
+	baseURL := resp.RawResponse.Request.URL
+	manifest, err := rewriteDASHManifest(resp.Body(), baseURL, newProxyLinkParams(req))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("解析 DASH 清单失败: %v", err), http.StatusBadGateway)
+		return
+	}
+	logrus.Debugf("已改写 DASH 清单: %v", baseURL)
+
+	contentType := resp.Header().Get("Content-Type")
+	if !strings.Contains(strings.ToLower(contentType), "dash+xml") {
+		contentType = "application/dash+xml"
+	}
+	writeManifest(w, contentType, manifest)
+}
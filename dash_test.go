@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	handleUrl "net/url"
+	"strings"
+	"testing"
+)
+
+func TestRewriteDASHManifest(t *testing.T) {
+	manifestURL, _ := handleUrl.Parse("https://cdn.example.com/vod/manifest.mpd")
+	lp := &proxyLinkParams{proxyBase: "http://127.0.0.1:7779/"}
+	templateLink := func(target string) string {
+		link, _ := dashTemplateLink(manifestURL, target, lp)
+		return escapeXMLText(link)
+	}
+
+	tests := []struct {
+		name     string
+		manifest string
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "AdaptationSet 的模板按 Representation 的 BaseURL 解析",
+			manifest: `<MPD><Period><AdaptationSet>` +
+				`<SegmentTemplate timescale="1000" media="$RepresentationID$/$Number$.m4s" initialization="$RepresentationID$/init.mp4"/>` +
+				`<Representation id="v1"><BaseURL>video/</BaseURL></Representation>` +
+				`<Representation id="v2"/>` +
+				`</AdaptationSet></Period></MPD>`,
+			contains: []string{
+				`<Representation id="v1"><SegmentTemplate media="` + templateLink("https://cdn.example.com/vod/video/$RepresentationID$/$Number$.m4s") + `" initialization="` + templateLink("https://cdn.example.com/vod/video/$RepresentationID$/init.mp4") + `"/></Representation>`,
+				`<SegmentTemplate timescale="1000" media="` + templateLink("https://cdn.example.com/vod/$RepresentationID$/$Number$.m4s") + `"`,
+				`<Representation id="v2"/>`,
+			},
+			excludes: []string{"<BaseURL>"},
+		},
+		{
+			name: "Representation 自身模板缺少的属性从上层继承",
+			manifest: `<MPD><BaseURL>https://media.example.com/</BaseURL><Period><AdaptationSet>` +
+				`<SegmentTemplate initialization="init.mp4"/>` +
+				`<Representation id="a"><BaseURL>audio/</BaseURL><SegmentTemplate media="$Number$.m4s"/></Representation>` +
+				`</AdaptationSet></Period></MPD>`,
+			contains: []string{
+				`<SegmentTemplate media="` + templateLink("https://media.example.com/audio/$Number$.m4s") + `" initialization="` + templateLink("https://media.example.com/audio/init.mp4") + `"/>`,
+			},
+			excludes: []string{"<BaseURL>"},
+		},
+		{
+			name: "BaseURL 为媒体文件地址时改写为代理链接",
+			manifest: `<MPD><BaseURL>https://media.example.com/vod/</BaseURL><Period><AdaptationSet>` +
+				`<Representation id="v"><BaseURL>video.mp4</BaseURL><SegmentBase indexRange="0-999"/></Representation>` +
+				`<Representation id="a"/>` +
+				`</AdaptationSet></Period></MPD>`,
+			contains: []string{
+				`<Representation id="v"><BaseURL>` + escapeXMLText(lp.link("https://media.example.com/vod/video.mp4")) + `</BaseURL>`,
+				`<Representation id="a"><BaseURL>` + escapeXMLText(lp.link("https://media.example.com/vod/")) + `</BaseURL></Representation>`,
+			},
+			excludes: []string{"<BaseURL>https://"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteDASHManifest([]byte(tt.manifest), manifestURL, lp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("结果中缺少\n%s\n结果为\n%s", want, got)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(string(got), unwanted) {
+					t.Errorf("结果中不应包含 %s\n结果为\n%s", unwanted, got)
+				}
+			}
+		})
+	}
+}
+
+// 模板链接的 url 不编码, header 与 HLS 等其他链接一样保持 base64 编码
+func TestDASHTemplateLinkKeepsHeaderEncoded(t *testing.T) {
+	manifestURL, _ := handleUrl.Parse("https://cdn.example.com/vod/manifest.mpd")
+	header := base64.StdEncoding.EncodeToString([]byte(`{"Referer":"https://example.com/"}`))
+	lp := &proxyLinkParams{proxyBase: "http://127.0.0.1:7779/", form: "base64", header: header}
+
+	link, ok := dashTemplateLink(manifestURL, "seg-$Number$.m4s", lp)
+	if !ok {
+		t.Fatal("dashTemplateLink() 失败")
+	}
+	parsed, err := handleUrl.Parse(strings.Replace(link, "$Number$", "1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("form") != "base64header" || query.Get("url") != "https://cdn.example.com/vod/seg-1.m4s" {
+		t.Errorf("模板链接的 form、url 参数不正确: %s", link)
+	}
+	hlsQuery, _ := handleUrl.ParseQuery(strings.TrimPrefix(lp.link("https://cdn.example.com/vod/seg-1.m4s"), lp.proxyBase+"?"))
+	if query.Get("header") != hlsQuery.Get("header") {
+		t.Errorf("模板链接的 header 参数 %q 与其他链接 %q 不一致", query.Get("header"), hlsQuery.Get("header"))
+	}
+}
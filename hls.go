@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	handleUrl "net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var hlsURIAttrRegex = regexp.MustCompile(`URI="([^"]*)"`)
+
+// isHLSPlaylist 根据 Content-Type 或扩展名判断是否为 HLS 播放列表
+func isHLSPlaylist(url string, contentType string) bool {
+	if strings.Contains(strings.ToLower(contentType), "mpegurl") {
+		return true
+	}
+	parsedURL, err := handleUrl.Parse(url)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(parsedURL.Path), ".m3u8")
+}
+
+// rewriteHLSPlaylist 将播放列表中的分片、密钥及子播放列表地址改写为代理链接
+func rewriteHLSPlaylist(playlist string, baseURL *handleUrl.URL, lp *proxyLinkParams) string {
+	proxyURI := func(uri string) string {
+		absURL, ok := resolveMediaURL(baseURL, uri)
+		if !ok {
+			// data:、skd:// 等非 http(s) 地址保持原样
+			return uri
+		}
+		return lp.link(absURL)
+	}
+
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		lines[i] = line
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "#") {
+			// #EXT-X-KEY、#EXT-X-MAP、#EXT-X-MEDIA 等标签中的 URI 属性
+			lines[i] = hlsURIAttrRegex.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := hlsURIAttrRegex.FindStringSubmatch(attr)[1]
+				return `URI="` + proxyURI(uri) + `"`
+			})
+			continue
+		}
+		lines[i] = proxyURI(trimmed)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleHLSPlaylist 下载完整播放列表并改写后返回给客户端
+func handleHLSPlaylist(w http.ResponseWriter, req *http.Request, url string, newHeader map[string][]string, jar *cookiejar.Jar) {
+	resp := fetchManifest(w, url, newHeader, jar)
+	if resp == nil {
+		return
+	}
+
+	// 以重定向后的最终地址作为相对路径的基准
+	baseURL := resp.RawResponse.Request.URL
+	playlist := rewriteHLSPlaylist(string(resp.Body()), baseURL, newProxyLinkParams(req))
+	logrus.Debugf("已改写 HLS 播放列表: %v", baseURL)
+
+	contentType := resp.Header().Get("Content-Type")
+	if !strings.Contains(strings.ToLower(contentType), "mpegurl") {
+		contentType = "application/vnd.apple.mpegurl"
+	}
+	writeManifest(w, contentType, []byte(playlist))
+}
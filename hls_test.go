@@ -0,0 +1,53 @@
+package main
+
+import (
+	handleUrl "net/url"
+	"testing"
+)
+
+func TestRewriteHLSPlaylist(t *testing.T) {
+	baseURL, _ := handleUrl.Parse("https://cdn.example.com/live/index.m3u8?token=abc")
+	lp := &proxyLinkParams{proxyBase: "http://127.0.0.1:7779/"}
+	link := func(target string) string {
+		return lp.link(target)
+	}
+
+	tests := []struct {
+		name     string
+		playlist string
+		want     string
+	}{
+		{
+			name:     "媒体分片",
+			playlist: "#EXTM3U\n#EXTINF:4.0,\nseg-1.ts\n#EXTINF:4.0,\n/abs/seg-2.ts\n#EXT-X-ENDLIST\n",
+			want:     "#EXTM3U\n#EXTINF:4.0,\n" + link("https://cdn.example.com/live/seg-1.ts") + "\n#EXTINF:4.0,\n" + link("https://cdn.example.com/abs/seg-2.ts") + "\n#EXT-X-ENDLIST\n",
+		},
+		{
+			name:     "子播放列表",
+			playlist: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nhttps://other.example.com/720p/index.m3u8\n",
+			want:     "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\n" + link("https://other.example.com/720p/index.m3u8") + "\n",
+		},
+		{
+			name:     "标签中的 URI 属性",
+			playlist: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0x1\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",URI=\"audio/index.m3u8\"\n",
+			want:     "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"" + link("https://cdn.example.com/live/key.bin") + "\",IV=0x1\n#EXT-X-MAP:URI=\"" + link("https://cdn.example.com/live/init.mp4") + "\"\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",URI=\"" + link("https://cdn.example.com/live/audio/index.m3u8") + "\"\n",
+		},
+		{
+			name:     "非 http 密钥地址保持原样",
+			playlist: "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key-id\"\n",
+			want:     "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key-id\"\n",
+		},
+		{
+			name:     "CRLF 换行",
+			playlist: "#EXTM3U\r\n#EXTINF:4.0,\r\nseg-1.ts\r\n",
+			want:     "#EXTM3U\n#EXTINF:4.0,\n" + link("https://cdn.example.com/live/seg-1.ts") + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteHLSPlaylist(tt.playlist, baseURL, lp); got != tt.want {
+				t.Errorf("rewriteHLSPlaylist() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	handleUrl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// proxyLinkParams 记录改写链接时需要沿用的代理参数
+type proxyLinkParams struct {
+	proxyBase string // 代理自身地址, 如 http://127.0.0.1:7779/
+	form      string
+	header    string // 原始 header 参数, 编码方式与 form 一致
+	thread    string
+	size      string
+}
+
+func newProxyLinkParams(req *http.Request) *proxyLinkParams {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	query := req.URL.Query()
+	return &proxyLinkParams{
+		proxyBase: scheme + "://" + req.Host + "/",
+		form:      query.Get("form"),
+		header:    query.Get("header"),
+		thread:    query.Get("thread"),
+		size:      query.Get("size"),
+	}
+}
+
+// link 生成经由代理访问 target 的链接
+func (lp *proxyLinkParams) link(target string) string {
+	values := handleUrl.Values{}
+	switch lp.form {
+	case "base64":
+		values.Set("form", "base64")
+		values.Set("url", base64.StdEncoding.EncodeToString([]byte(target)))
+	case "base64header":
+		values.Set("form", "base64header")
+		values.Set("url", target)
+	default:
+		values.Set("url", target)
+	}
+	if lp.header != "" {
+		values.Set("header", lp.header)
+	}
+	if lp.thread != "" {
+		values.Set("thread", lp.thread)
+	}
+	if lp.size != "" {
+		values.Set("size", lp.size)
+	}
+	return lp.proxyBase + "?" + values.Encode()
+}
+
+// template 返回用于模板链接的参数副本, url 中的标识符需由播放器替换, 不能使用 base64 编码
+// header 仍按 base64 编码, 与其他链接保持一致
+func (lp *proxyLinkParams) template() *proxyLinkParams {
+	templateParams := *lp
+	if lp.form == "base64" {
+		templateParams.form = "base64header"
+	}
+	return &templateParams
+}
+
+// resolveMediaURL 以 baseURL 为基准解析相对地址, 仅返回 http(s) 链接
+func resolveMediaURL(baseURL *handleUrl.URL, ref string) (string, bool) {
+	refURL, err := handleUrl.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", false
+	}
+	absURL := baseURL.ResolveReference(refURL)
+	if absURL.Scheme != "http" && absURL.Scheme != "https" {
+		return "", false
+	}
+	return absURL.String(), true
+}
+
+// fetchManifest 下载完整的播放列表/清单文件, 失败时直接向客户端返回错误并返回 nil
+func fetchManifest(w http.ResponseWriter, url string, newHeader map[string][]string, jar *cookiejar.Jar) *resty.Response {
+	resp, err := base.SessionClient(base.RestyClientWithProxy, jar, 10*time.Second, 3).
+		R().
+		SetHeaderMultiValues(newHeader).
+		Get(url)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("下载 %v 清单失败: %v", url, err), http.StatusInternalServerError)
+		return nil
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 400 {
+		http.Error(w, resp.String(), resp.StatusCode())
+		return nil
+	}
+	return resp
+}
+
+// writeManifest 返回改写后的清单内容
+func writeManifest(w http.ResponseWriter, contentType string, manifest []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Write(manifest)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// 单线程转发时源站连接中断后的最大连续重连次数, 重连间隔从 passthroughBackoff 开始加倍, 最长 passthroughMaxBackoff
+const passthroughMaxRetries = 5
+const passthroughMaxBackoff = 8 * time.Second
+
+var passthroughBackoff = time.Second
+
+// errResumeUnsupported 表示源站无法从中断处继续, 重连没有意义
+var errResumeUnsupported = errors.New("源站不支持从中断处继续")
+
+// servePassthrough 以单线程转发不支持断点续传或长度未知的源站响应
+// 先写出响应头, 再边读边写并立即 Flush; 长度未知时使用 chunked 传输, 直播等无尽的流一直转发到任一端断开
+// 源站连接中断时自动重连, 见 resumePassthrough; 无法恢复时中止连接, 避免客户端把不完整的 chunked 响应当作完整内容
+func servePassthrough(w http.ResponseWriter, req *http.Request, url string, newHeader map[string][]string, jar *cookiejar.Jar, resp *resty.Response, header http.Header) {
+	body := resp.RawBody()
+	defer func() {
+		body.Close()
+	}()
+
+	for key, values := range header {
+		switch strings.ToLower(key) {
+		case "connection", "proxy-connection", "keep-alive", "transfer-encoding", "content-length", "content-range":
+			continue
+		}
+		w.Header().Set(key, strings.Join(values, ","))
+	}
+	length := resp.RawResponse.ContentLength
+	if length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	live, _ := strconv.ParseBool(req.URL.Query().Get("live"))
+	controller := http.NewResponseController(w)
+	buf := base.GetBuffer(64 * 1024)
+	defer base.PutBuffer(buf)
+	delivered := int64(0)
+	retries := 0
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				logrus.Debugf("向客户端写入 Response 失败: %v", writeErr)
+				return
+			}
+			controller.Flush()
+			delivered += int64(n)
+			retries = 0
+		}
+		if err == nil {
+			continue
+		}
+		if req.Context().Err() != nil || (err == io.EOF && (length < 0 || delivered >= length)) {
+			return
+		}
+
+		// 源站连接中断, 按退避间隔重连, 直到恢复或超过重连次数
+		for {
+			if retries >= passthroughMaxRetries || errors.Is(err, errResumeUnsupported) {
+				logrus.Errorf("读取 %v 中断, 已重连 %d 次仍失败: %v", url, retries, err)
+				if length < 0 {
+					panic(http.ErrAbortHandler)
+				}
+				return
+			}
+			backoff := min(passthroughBackoff<<retries, passthroughMaxBackoff)
+			retries++
+			logrus.Infof("读取 %v 在 %d 字节处中断: %v, %v 后第 %d 次重连", url, delivered, err, backoff, retries)
+			if !sleepContext(req.Context(), backoff) {
+				return
+			}
+			body.Close()
+			var resumed io.ReadCloser
+			resumed, err = resumePassthrough(req, url, newHeader, jar, header, delivered, length, live)
+			if err == nil {
+				body = resumed
+				break
+			}
+		}
+	}
+}
+
+// resumePassthrough 重新连接源站, 返回从 delivered 处继续的响应体
+// 链接参数 live 标明的直播流不带 Range 重新请求, 从最新的位置继续
+// 其余情况请求 bytes=delivered-, 源站需返回起点一致的 206; 长度已知时源站忽略 Range 可跳过已转发的数据
+func resumePassthrough(req *http.Request, url string, newHeader map[string][]string, jar *cookiejar.Jar, header http.Header, delivered int64, length int64, live bool) (io.ReadCloser, error) {
+	request := base.SessionClient(base.RestyClientWithProxy, jar, 0, 1).
+		R().
+		SetContext(req.Context()).
+		SetDoNotParseResponse(true).
+		SetHeaderMultiValues(newHeader)
+	if !live {
+		request.SetHeader("Range", fmt.Sprintf("bytes=%d-", delivered))
+	}
+	resp, err := request.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.RawBody()
+
+	switch {
+	case live && resp.StatusCode() == http.StatusOK:
+		return body, nil
+	case !sameValidator(header, resp.Header()):
+		err = fmt.Errorf("源站文件已变化: %w", errResumeUnsupported)
+	case resp.StatusCode() == http.StatusPartialContent:
+		start, _, _, ok := parseContentRange(resp.Header().Get("Content-Range"))
+		if ok && start == delivered {
+			return body, nil
+		}
+		err = fmt.Errorf("请求 bytes=%d- 时源站返回的 Content-Range 为 %q", delivered, resp.Header().Get("Content-Range"))
+	case resp.StatusCode() == http.StatusOK && length < 0:
+		// 长度未知时无法确认重新返回的内容与已转发的一致, 拼接可能导致数据重复或错乱
+		err = fmt.Errorf("请求 bytes=%d- 时源站返回了 200: %w", delivered, errResumeUnsupported)
+	case resp.StatusCode() == http.StatusOK:
+		if _, err = io.CopyN(io.Discard, body, delivered); err == nil {
+			return body, nil
+		}
+	default:
+		err = fmt.Errorf("statusCode: %d", resp.StatusCode())
+	}
+	body.Close()
+	return nil, err
+}
+
+// sameValidator 判断两次响应的 ETag 与 Last-Modified 是否一致, 任一方没有时不比较
+func sameValidator(previous http.Header, current http.Header) bool {
+	for _, key := range []string{"ETag", "Last-Modified"} {
+		if previous.Get(key) != "" && current.Get(key) != "" && previous.Get(key) != current.Get(key) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	handleUrl "net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"MediaProxy/base"
+)
+
+// 长度未知的单线程转发在源站连接中断后, 只有从中断处继续的 206 或标明为直播的流可以接上
+func TestServePassthroughResume(t *testing.T) {
+	base.InitClient()
+	savedBackoff := passthroughBackoff
+	passthroughBackoff = 10 * time.Millisecond
+	defer func() {
+		passthroughBackoff = savedBackoff
+	}()
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	restarted := []byte("restarted live stream")
+	const dropAt = 20000
+
+	tests := []struct {
+		name string
+		live bool
+		// resume 响应重连请求
+		resume   func(w http.ResponseWriter, r *http.Request)
+		want     []byte
+		wantFail bool
+	}{
+		{
+			name: "起点一致的 206 继续转发",
+			resume: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != fmt.Sprintf("bytes=%d-", dropAt) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", dropAt, len(data)-1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data[dropAt:])
+			},
+			want: data,
+		},
+		{
+			name: "源站返回 200 时中止",
+			resume: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(data)
+			},
+			wantFail: true,
+		},
+		{
+			name: "起点不一致的 206 时中止",
+			resume: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/*", len(data)-1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data)
+			},
+			wantFail: true,
+		},
+		{
+			name: "直播流重新请求",
+			live: true,
+			resume: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write(restarted)
+			},
+			want: append(append([]byte(nil), data[:dropAt]...), restarted...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int64
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt64(&requests, 1) > 1 {
+					tt.resume(w, r)
+					return
+				}
+				// 首次请求忽略 Range, 以 chunked 返回前 dropAt 字节后断开连接
+				w.Header().Set("Content-Type", "video/mp2t")
+				w.Write(data[:dropAt])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}))
+			defer upstream.Close()
+			proxy := httptest.NewServer(http.HandlerFunc(handleMethod))
+			defer proxy.Close()
+
+			link := proxy.URL + "/?url=" + handleUrl.QueryEscape(upstream.URL+"/stream.ts")
+			if tt.live {
+				link += "&live=1"
+			}
+			resp, err := http.Get(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if tt.wantFail {
+				if err == nil {
+					t.Errorf("源站无法继续时响应正常结束, 收到 %d 字节", len(body))
+				}
+				if !bytes.Equal(body, data[:len(body)]) || len(body) > dropAt {
+					t.Errorf("中止前收到了中断处之后的数据, 共 %d 字节", len(body))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("读取响应失败: %v, 收到 %d 字节", err, len(body))
+			}
+			if !bytes.Equal(body, tt.want) {
+				t.Errorf("收到 %d 字节, 与预期的 %d 字节不一致", len(body), len(tt.want))
+			}
+		})
+	}
+}
@@ -2,17 +2,18 @@ package main
 
 import (
 	// 标准库
-	"crypto/tls"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"math"
-	"net"
 	"net/http"
 	"net/http/cookiejar"
 	handleUrl "net/url"
@@ -23,9 +24,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"sort"
 
 	// 本地包
 	"MediaProxy/base"
@@ -35,7 +36,6 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
-	"github.com/miekg/dns"
 )
 
 //go:embed static/index.html
@@ -43,78 +43,319 @@ import (
 var embedRes embed.FS
 
 var workPool = false
+var adaptiveThread = false
+var minThread = int64(1)
+var maxThread = int64(32)
+var minChunkSize = int64(64 * 1024)
+var maxChunkSize = int64(4 * 1024 * 1024)
+var fastChunkDuration = 1 * time.Second
+var slowChunkDuration = 5 * time.Second
+var hedgeDelay = 2 * time.Second
+var hedgeSlowFactor = float64(4)
+var hedgeCheckInterval = 200 * time.Millisecond
+var headersRevalidateInterval = 60 * time.Second
 var proxyTimeout = int64(10)
 var mediaCache = cache.New(4*time.Hour, 10*time.Minute)
+var chunkCache = base.NewChunkCache(0)
+var diskCache *base.DiskCache
 
 type SSLConfig struct {
     Cert *string `json:"cert"`
     Key  *string `json:"key"`
 }
 
+type AdaptiveThreadConfig struct {
+	Enable *bool  `json:"enable"`
+	Min    *int64 `json:"min"`
+	Max    *int64 `json:"max"`
+}
+
+type DiskCacheConfig struct {
+	Dir     *string `json:"dir"`
+	MaxSize *int64  `json:"maxSize"`
+}
+
+type UpstreamProxyRuleConfig struct {
+	Match string `json:"match"`
+	Proxy string `json:"proxy"`
+}
+
+type UpstreamProxyPoolConfig struct {
+	Proxies  []string `json:"proxies"`
+	Strategy string   `json:"strategy"`
+}
+
+type UpstreamProxyConfig struct {
+	Proxies map[string]string                  `json:"proxies"`
+	Pools   map[string]UpstreamProxyPoolConfig `json:"pools"`
+	Rules   []UpstreamProxyRuleConfig          `json:"rules"`
+	Default *string                            `json:"default"`
+}
+
+type DNSCacheConfig struct {
+	MinTTL    *int64 `json:"minTTL"`
+	MaxTTL    *int64 `json:"maxTTL"`
+	FastestIP *bool  `json:"fastestIP"`
+}
+
+type DNSBenchmarkConfig struct {
+	Interval *int64  `json:"interval"`
+	Domain   *string `json:"domain"`
+}
+
+type TLSDomainConfig struct {
+	Verify      *bool    `json:"verify"`
+	Pins        []string `json:"pins"`
+	ClientCert  string   `json:"clientCert"`
+	ClientKey   string   `json:"clientKey"`
+	Fingerprint string   `json:"fingerprint"`
+	Protocol    string   `json:"protocol"`
+}
+
+type TLSConfig struct {
+	Verify      *bool                      `json:"verify"`
+	CAFiles     []string                   `json:"caFiles"`
+	Pins        []string                   `json:"pins"`
+	ClientCert  string                     `json:"clientCert"`
+	ClientKey   string                     `json:"clientKey"`
+	Fingerprint string                     `json:"fingerprint"`
+	Protocol    string                     `json:"protocol"`
+	Domains     map[string]TLSDomainConfig `json:"domains"`
+}
+
 type Config struct {
-	WorkPool *bool           `json:"workPool"`
-	Debug    *bool           `json:"debug"`
-	Port     json.RawMessage `json:"port"`
-	SSL      *SSLConfig      `json:"ssl"`
-	DNS      *string         `json:"dns"`
+	WorkPool       *bool                 `json:"workPool"`
+	Debug          *bool                 `json:"debug"`
+	Port           json.RawMessage       `json:"port"`
+	SSL            *SSLConfig            `json:"ssl"`
+	DNS            json.RawMessage       `json:"dns"`
+	ChunkCache     *int64                `json:"chunkCache"`
+	DiskCache      *DiskCacheConfig      `json:"diskCache"`
+	AdaptiveThread *AdaptiveThreadConfig `json:"adaptiveThread"`
+	UpstreamProxy  *UpstreamProxyConfig  `json:"upstreamProxy"`
+	LocalAddress   []string              `json:"localAddress"`
+	DNSCache       *DNSCacheConfig       `json:"dnsCache"`
+	Hosts          map[string]string     `json:"hosts"`
+	DNSBenchmark   *DNSBenchmarkConfig   `json:"dnsBenchmark"`
+	TLS            *TLSConfig            `json:"tls"`
 }
 
 type Chunk struct {
 	startOffset int64
 	endOffset   int64
 	buffer      []byte
+	mutex       sync.Mutex
+	filled      int64                // 从分块起点开始已连续写入的字节数
+	updated     chan struct{}        // 写入数据时关闭并替换, 用于通知读取方
+	pooled      bool                 // buffer 是否来自缓冲池
+	refs        int32                // 下载方与读取方各持有一个引用, 均释放后归还缓冲池
+	fetchTime   time.Time            // 开始下载的时间
+	hedged      bool                 // 是否已发出对冲请求
+	cancels     []context.CancelFunc // 该分块所有进行中的请求
 }
 
 func newChunk(start int64, end int64) *Chunk {
 	return &Chunk{
 		startOffset: start,
 		endOffset:   end,
+		updated:     make(chan struct{}),
+		refs:        2,
 	}
 }
 
-func (ch *Chunk) get() []byte {
+func (ch *Chunk) size() int64 {
+	return ch.endOffset - ch.startOffset + 1
+}
+
+// allocate 为分块分配缓冲区, pooled 为 true 时使用缓冲池
+func (ch *Chunk) allocate(pooled bool) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.buffer != nil {
+		return
+	}
+	ch.pooled = pooled
+	if pooled {
+		ch.buffer = base.GetBuffer(int(ch.size()))
+	} else {
+		ch.buffer = make([]byte, ch.size())
+	}
+}
+
+// load 在持有锁的情况下直接访问缓冲区, 用于预先填入磁盘缓存的数据
+func (ch *Chunk) load(fn func(buffer []byte)) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	fn(ch.buffer)
+}
+
+// data 返回分块缓冲区, 已写入部分的内容不会再改变
+func (ch *Chunk) data() []byte {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
 	return ch.buffer
 }
 
-func (ch *Chunk) put(buffer []byte) {
+func (ch *Chunk) filledBytes() int64 {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	return ch.filled
+}
+
+func (ch *Chunk) isDone() bool {
+	return ch.filledBytes() == ch.size()
+}
+
+// available 返回从 pos 开始已可读取的数据, 以及下次写入时会被关闭的通知通道
+func (ch *Chunk) available(pos int64) ([]byte, <-chan struct{}) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if pos < ch.filled {
+		return ch.buffer[pos:ch.filled], ch.updated
+	}
+	return nil, ch.updated
+}
+
+// writeAt 写入从分块内偏移 pos 开始的数据, 已写入的部分直接跳过
+// 主请求与对冲请求可同时写入, 进度较快的一方推动分块完成
+func (ch *Chunk) writeAt(pos int64, data []byte) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.filled == ch.size() || pos > ch.filled {
+		return
+	}
+	skip := ch.filled - pos
+	if skip >= int64(len(data)) {
+		return
+	}
+	ch.filled += int64(copy(ch.buffer[ch.filled:], data[skip:]))
+	ch.notifyLocked()
+}
+
+// advance 将已通过其他方式填入缓冲区的数据标记为可读取
+func (ch *Chunk) advance(filled int64) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if filled > ch.filled {
+		ch.filled = filled
+		ch.notifyLocked()
+	}
+}
+
+// fill 使用缓存或其他会话下载的完整数据填充分块
+func (ch *Chunk) fill(buffer []byte) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.filled == ch.size() {
+		return
+	}
 	ch.buffer = buffer
+	ch.pooled = false
+	ch.filled = ch.size()
+	ch.notifyLocked()
+}
+
+// notifyLocked 通知读取方有新数据, 分块完成时取消其余进行中的请求, 调用方需持有锁
+func (ch *Chunk) notifyLocked() {
+	close(ch.updated)
+	ch.updated = make(chan struct{})
+	if ch.filled == ch.size() {
+		for _, cancel := range ch.cancels {
+			cancel()
+		}
+		ch.cancels = nil
+	}
+}
+
+// release 释放一个引用, 下载方与读取方均释放后归还缓冲区
+func (ch *Chunk) release() {
+	if atomic.AddInt32(&ch.refs, -1) != 0 {
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.pooled && ch.filled == ch.size() {
+		base.PutBuffer(ch.buffer)
+		ch.buffer = nil
+		ch.pooled = false
+	}
+}
+
+// startFetch 登记一个针对该分块的请求, 返回的 context 会在分块完成或会话结束时被取消
+func (ch *Chunk) startFetch(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.fetchTime.IsZero() {
+		ch.fetchTime = time.Now()
+	}
+	if ch.filled == ch.size() {
+		cancel()
+	} else {
+		ch.cancels = append(ch.cancels, cancel)
+	}
+	return ctx, cancel
 }
 
 type ProxyDownloadStruct struct {
-	ProxyRunning         bool
+	ctx                  context.Context // 会话的生命周期, 客户端断开或读取结束时取消
+	cancel               context.CancelFunc
 	NextChunkStartOffset int64
-	CurrentOffset        int64
+	CurrentOffset        atomic.Int64 // 读取方已返回的位置
 	CurrentChunk         int64
-	ChunkSize            int64
+	ChunkSize            int64 // 当前分块大小, 在 MinChunkSize 与 MaxChunkSize 之间动态调整, 由 rateMutex 保护
+	MinChunkSize         int64
+	MaxChunkSize         int64
 	MaxBufferedChunk     int64
+	QueuedBytes          atomic.Int64 // 已生成但未被读取的分块总大小
 	startOffset          int64
 	EndOffset            int64
-	ProxyMutex           *sync.Mutex
+	ProxyMutex           *sync.Mutex // 保证分块按顺序生成并入队, 持有时可能阻塞在已满的 ReadyChunkQueue 上, 读取方不可使用
+	rateMutex            sync.Mutex  // 保护 ChunkSize 与 ChunkRate
 	ProxyTimeout         int64
 	ReadyChunkQueue      chan *Chunk
 	ThreadCount          int64
 	DownloadUrl          string
 	CookieJar            *cookiejar.Jar
+	Client               *resty.Client // 会话专用的客户端, 与全局客户端共用连接池
+	HedgeClient          *resty.Client // 会话专用的对冲请求客户端
 	OriginThreadNum      int
+	Validator            base.CacheValidator
+	DownloadedBytes      atomic.Int64 // 从源站下载的总字节数
+	ActiveWorkers        atomic.Int64 // 正在运行的下载协程数
+	RetireWorkers        atomic.Int64 // 等待退出的下载协程数
+	ThrottledCount       atomic.Int64 // 源站返回错误或限流的次数
+	ChunkRate            float64      // 分块下载速度的滑动平均值, 由 rateMutex 保护
+	headChunk            *Chunk       // 正在读取的分块, 仅由读取方访问
+	headPos              int64        // 正在读取的分块内的偏移
+	consumedChunk        *Chunk       // 已读完但数据可能仍在写出的分块
 }
 
-func newProxyDownloadStruct(downloadUrl string, proxyTimeout int64, maxBuferredChunk int64, chunkSize int64, startOffset int64, endOffset int64, numTasks int64, cookiejar *cookiejar.Jar, originThreadNum int) *ProxyDownloadStruct {
-	return &ProxyDownloadStruct{
-		ProxyRunning:         true,
+func newProxyDownloadStruct(parent context.Context, downloadUrl string, proxyTimeout int64, maxBuferredChunk int64, chunkSize int64, maxChunkSize int64, startOffset int64, endOffset int64, numTasks int64, cookiejar *cookiejar.Jar, originThreadNum int, validator base.CacheValidator) *ProxyDownloadStruct {
+	ctx, cancel := context.WithCancel(parent)
+	p := &ProxyDownloadStruct{
+		ctx:                  ctx,
+		cancel:               cancel,
 		MaxBufferedChunk:     int64(maxBuferredChunk),
 		ProxyTimeout:         proxyTimeout,
 		ReadyChunkQueue:      make(chan *Chunk, maxBuferredChunk),
 		ProxyMutex:           &sync.Mutex{},
 		ChunkSize:            chunkSize,
+		MinChunkSize:         chunkSize,
+		MaxChunkSize:         maxChunkSize,
 		NextChunkStartOffset: startOffset,
-		CurrentOffset:        startOffset,
 		startOffset:          startOffset,
 		EndOffset:            endOffset,
 		ThreadCount:          numTasks,
 		DownloadUrl:          downloadUrl,
 		CookieJar:            cookiejar,
+		Client:               base.SessionClient(base.RestyClientWithProxy, cookiejar, 10*time.Second, 1),
+		HedgeClient:          base.SessionClient(base.HedgeClient, cookiejar, 10*time.Second, 1),
 		OriginThreadNum:      originThreadNum,
+		Validator:            validator,
 	}
+	p.CurrentOffset.Store(startOffset)
+	return p
 }
 
 func ConcurrentDownload(p *ProxyDownloadStruct, downloadUrl string, rangeStart int64, rangeEnd int64, splitSize int64, numTasks int64, emitter *base.Emitter, req *http.Request, jar *cookiejar.Jar) {
@@ -126,6 +367,7 @@ func ConcurrentDownload(p *ProxyDownloadStruct, downloadUrl string, rangeStart i
 
 	logrus.Debugf("正在处理: %+v, rangeStart: %+v, rangeEnd: %+v, contentLength :%+v, splitSize: %+v, numSplits: %+v, numTasks: %+v", downloadUrl, rangeStart, rangeEnd, totalLength, splitSize, numSplits, numTasks)
 
+	var startWorker func()
 	if workPool {
 		var wp *workpool.WorkPool
 		workPoolKey := downloadUrl + "#Workpool"
@@ -141,25 +383,31 @@ func ConcurrentDownload(p *ProxyDownloadStruct, downloadUrl string, rangeStart i
 			wp.SetTimeout(time.Duration(proxyTimeout) * time.Second)
 			mediaCache.Set(workPoolKey, wp, 14400*time.Second)
 		}
-		for numSplit := 0; numSplit < int(numSplits); numSplit++ {
+		startWorker = func() {
 			wp.Do(func() error {
 				p.ProxyWorker(req)
 				return nil
 			})
 		}
 	} else {
-		for numSplit := 0; numSplit < int(numSplits); numSplit++ {
+		startWorker = func() {
 			go p.ProxyWorker(req)
 		}
 	}
+	for numSplit := 0; numSplit < int(numSplits); numSplit++ {
+		startWorker()
+	}
+	if adaptiveThread {
+		// 工作池按 numTasks 限定并发, 自适应增加的协程直接启动, 总数由 AdjustWorkers 限定在 maxThread 以内
+		go p.AdjustWorkers(func() {
+			go p.ProxyWorker(req)
+		})
+	}
 
-	defer func() {
-		p.ProxyStop()
-		p = nil
-	}()
+	defer p.ProxyStop()
 
 	for {
-		buffer := p.ProxyRead()
+		buffer := p.ProxyRead(req)
 
 		if len(buffer) == 0 {
 			p.ProxyStop()
@@ -179,7 +427,7 @@ func ConcurrentDownload(p *ProxyDownloadStruct, downloadUrl string, rangeStart i
 			return
 		}
 
-		if p.CurrentOffset >= rangeEnd {
+		if p.CurrentOffset.Load() > rangeEnd {
 			p.ProxyStop()
 			emitter.Close()
 			logrus.Debugf("所有服务已经完成大小: %+v", totalLength)
@@ -190,76 +438,193 @@ func ConcurrentDownload(p *ProxyDownloadStruct, downloadUrl string, rangeStart i
 	}
 }
 
-func (p *ProxyDownloadStruct) ProxyRead() []byte {
+// AdjustWorkers 根据实测吞吐量动态增减下载协程
+// 总吞吐量随协程增加而明显上升时继续增加, 趋于平稳或源站报错、限流时减少, 协程数保持在 minThread 与 maxThread 之间
+func (p *ProxyDownloadStruct) AdjustWorkers(startWorker func()) {
+	const interval = 2 * time.Second
+	var lastBytes int64
+	var rateBeforeAdd float64
+	added := false
+	cooldown := 0
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+
+		downloadedBytes := p.DownloadedBytes.Load()
+		rate := float64(downloadedBytes-lastBytes) / interval.Seconds()
+		lastBytes = downloadedBytes
+		active := p.ActiveWorkers.Load() - p.RetireWorkers.Load()
+		throttled := p.ThrottledCount.Swap(0)
+		if active <= 0 {
+			continue
+		}
+		logrus.Debugf("下载协程数: %d, 总速度: %.0f KB/s, 单协程速度: %.0f KB/s", active, rate/1024, rate/float64(active)/1024)
+
+		p.ProxyMutex.Lock()
+		hasPendingChunk := p.NextChunkStartOffset <= p.EndOffset
+		p.ProxyMutex.Unlock()
+
+		switch {
+		case throttled > 0:
+			// 源站报错或限流, 减少协程并暂停增加
+			if active > minThread {
+				p.RetireWorkers.Add(1)
+				logrus.Debugf("源站返回 %d 次错误或限流, 下载协程减少至 %d", throttled, active-1)
+			}
+			added = false
+			cooldown = 5
+		case added && rate < rateBeforeAdd*1.1:
+			// 增加协程后速度没有明显提升, 撤回本次增加
+			if active > minThread {
+				p.RetireWorkers.Add(1)
+				logrus.Debugf("下载速度趋于平稳, 下载协程减少至 %d", active-1)
+			}
+			added = false
+			cooldown = 5
+		case cooldown > 0:
+			cooldown--
+			added = false
+		case active < maxThread && hasPendingChunk:
+			rateBeforeAdd = rate
+			added = true
+			startWorker()
+			logrus.Debugf("下载速度仍有提升空间, 下载协程增加至 %d", active+1)
+		default:
+			added = false
+		}
+	}
+}
+
+// shouldRetire 判断当前协程是否需要退出, 用于减少下载协程
+func (p *ProxyDownloadStruct) shouldRetire() bool {
+	for {
+		retire := p.RetireWorkers.Load()
+		if retire <= 0 {
+			return false
+		}
+		if p.RetireWorkers.CompareAndSwap(retire, retire-1) {
+			return true
+		}
+	}
+}
+
+func (p *ProxyDownloadStruct) ProxyRead(req *http.Request) []byte {
+	// 上次返回的数据已写出, 释放已读完的分块
+	if p.consumedChunk != nil {
+		p.consumedChunk.release()
+		p.consumedChunk = nil
+	}
+
 	// 判断文件是否下载结束
-	if p.CurrentOffset >= p.EndOffset {
+	if p.CurrentOffset.Load() > p.EndOffset {
 		p.ProxyStop()
 		return nil
 	}
 
-	// 获取当前的chunk的数据
-	var currentChunk *Chunk
-	select {
-	case currentChunk = <-p.ReadyChunkQueue:
-		break
-	case <-time.After(time.Duration(p.ProxyTimeout) * time.Second):
-		logrus.Debugf("执行 ProxyRead 超时")
-		p.ProxyStop()
-		return nil
+	// 获取当前的chunk
+	if p.headChunk == nil {
+		select {
+		case p.headChunk = <-p.ReadyChunkQueue:
+			p.headPos = 0
+		case <-time.After(time.Duration(p.ProxyTimeout) * time.Second):
+			logrus.Debugf("执行 ProxyRead 超时")
+			p.ProxyStop()
+			return nil
+		case <-p.ctx.Done():
+			return nil
+		}
 	}
 
+	// 返回当前chunk已下载的数据, 无需等待整个chunk下载完成
+	currentChunk := p.headChunk
 	for {
-		if !p.ProxyRunning {
-			break
-		}
-		buffer := currentChunk.get()
+		buffer, updated := currentChunk.available(p.headPos)
 		if len(buffer) > 0 {
-			p.CurrentOffset += int64(len(buffer))
-			currentChunk = nil
+			p.headPos += int64(len(buffer))
+			p.CurrentOffset.Add(int64(len(buffer)))
+			if p.headPos == currentChunk.size() {
+				p.QueuedBytes.Add(-currentChunk.size())
+				p.consumedChunk = currentChunk
+				p.headChunk = nil
+			}
 			return buffer
-		} else {
-			time.Sleep(50 * time.Millisecond)
+		}
+		select {
+		case <-updated:
+		case <-time.After(hedgeCheckInterval):
+			p.checkStraggler(req, currentChunk)
+		case <-p.ctx.Done():
+			return nil
 		}
 	}
-	currentChunk = nil
-	return nil
 }
 
+// ProxyStop 结束会话, 立即取消该会话所有进行中的源站请求
 func (p *ProxyDownloadStruct) ProxyStop() {
-	p.ProxyRunning = false
-	var currentChunk *Chunk
-	for {
-		select {
-		case currentChunk = <-p.ReadyChunkQueue:
-			currentChunk.buffer = nil
-			currentChunk = nil
-		case <-time.After(1 * time.Second):
-			return
-		}
+	p.cancel()
+}
+
+// running 判断会话是否仍在进行
+func (p *ProxyDownloadStruct) running() bool {
+	return p.ctx.Err() == nil
+}
+
+// sleepContext 等待 d 或 ctx 取消, ctx 已取消时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
 func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
+	// 在工作池中排队期间会话已结束
+	if !p.running() {
+		return
+	}
 	logrus.Debugf("当前活跃的协程数量: %d", runtime.NumGoroutine()-p.OriginThreadNum)
+	p.ActiveWorkers.Add(1)
+	defer p.ActiveWorkers.Add(-1)
 	for {
-		if !p.ProxyRunning {
+		if !p.running() {
+			break
+		}
+		if p.shouldRetire() {
 			break
 		}
 
 		p.ProxyMutex.Lock()
-		// 生成下一个chunk
+		// 生成下一个chunk, 边界按 ChunkSize 对齐以便不同会话复用分块缓存
 		var chunk *Chunk
 		chunk = nil
+		p.rateMutex.Lock()
+		chunkSize := p.ChunkSize
+		p.rateMutex.Unlock()
 		startOffset := p.NextChunkStartOffset
-		p.NextChunkStartOffset += p.ChunkSize
+		endOffset := (startOffset/chunkSize+1)*chunkSize - 1
+		p.NextChunkStartOffset = endOffset + 1
 		if startOffset <= p.EndOffset {
-			endOffset := startOffset + p.ChunkSize - 1
 			if endOffset > p.EndOffset {
 				endOffset = p.EndOffset
 			}
 			chunk = newChunk(startOffset, endOffset)
 
-			p.ReadyChunkQueue <- chunk
+			p.QueuedBytes.Add(endOffset - startOffset + 1)
+			select {
+			case p.ReadyChunkQueue <- chunk:
+			case <-p.ctx.Done():
+				chunk = nil
+			}
 		}
 		p.ProxyMutex.Unlock()
 
@@ -269,97 +634,366 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 		}
 
 		for {
-			if !p.ProxyRunning {
+			// 过多的数据未被取走，先休息一下，避免内存溢出
+			remainingSize := p.GetRemainingSize()
+			maxBufferSize := p.MinChunkSize * p.MaxBufferedChunk
+			if remainingSize < maxBufferSize {
+				break
+			}
+			logrus.Debugf("未读取数据: %d >= 缓冲区: %d ，先休息一下，避免内存溢出", remainingSize, maxBufferSize)
+			if !sleepContext(p.ctx, 1*time.Second) {
 				break
-			} else {
-				// 过多的数据未被取走，先休息一下，避免内存溢出
-				remainingSize := p.GetRemainingSize(p.ChunkSize)
-				maxBufferSize := p.ChunkSize * p.MaxBufferedChunk
-				if remainingSize >= maxBufferSize {
-					logrus.Debugf("未读取数据: %d >= 缓冲区: %d ，先休息一下，避免内存溢出", remainingSize, maxBufferSize)
-					time.Sleep(1 * time.Second)
-				} else {
-					// logrus.Debugf("未读取数据: %d < 缓冲区: %d , 下载继续", remainingSize, maxBufferSize)
-					break
-				}
 			}
 		}
 
+		if !p.running() {
+			break
+		}
+
+		// 优先使用分块缓存, 其他会话正在下载的同一分块直接等待其结果
+		cacheKey := base.ChunkCacheKey(p.DownloadUrl, p.Validator, chunk.startOffset, chunk.endOffset)
+		var buffer []byte
+		var err error
 		for {
-			if !p.ProxyRunning {
+			ctx, cancel := chunk.startFetch(p.ctx)
+			buffer, err = chunkCache.Fetch(cacheKey, func() ([]byte, error) {
+				return p.loadChunk(ctx, req, chunk)
+			})
+			cancel()
+			if err == nil || !errors.Is(err, context.Canceled) || !p.running() || chunk.isDone() {
 				break
-			} else {
-				// 建立连接
-				rangeStr := fmt.Sprintf("bytes=%d-%d", chunk.startOffset, chunk.endOffset)
-				newHeader := make(map[string][]string)
-				for key, value := range req.Header {
-					if !shouldFilterHeaderName(key) {
-						newHeader[key] = value
-					}
-				}
+			}
+			// 等待的是其他会话的下载, 该会话结束后由本会话重新下载
+		}
+		if err == nil {
+			// 缓存命中或由其他会话下载完成
+			chunk.fill(buffer)
+		}
+		chunk.release()
+		if err != nil && !chunk.isDone() {
+			if p.running() {
+				p.ProxyStop()
+			}
+			return
+		}
+	}
+}
 
-				maxRetries := 5
-				if startOffset < int64(1048576) || (p.EndOffset-startOffset)/p.EndOffset*1000 < 2 {
-					maxRetries = 7
-				}
+// checkStraggler 检查队首分块的下载进度, 明显慢于其他分块时在新连接上发出对冲请求
+func (p *ProxyDownloadStruct) checkStraggler(req *http.Request, chunk *Chunk) {
+	chunk.mutex.Lock()
+	fetchTime := chunk.fetchTime
+	hedged := chunk.hedged
+	chunk.mutex.Unlock()
+	if hedged || fetchTime.IsZero() {
+		return
+	}
+	elapsed := time.Since(fetchTime)
+	if elapsed < hedgeDelay {
+		return
+	}
 
-				var resp *resty.Response
-				var err error
-				for retry := 0; retry < maxRetries; retry++ {
-					resp, err = base.RestyClient.
-						SetTimeout(10*time.Second).
-						SetRetryCount(1).
-						SetCookieJar(p.CookieJar).
-						R().
-						SetHeaderMultiValues(newHeader).
-						SetHeader("Range", rangeStr).
-						Get(p.DownloadUrl)
-
-					if err != nil {
-						logrus.Errorf("处理 %+v 链接 range=%d-%d 部分失败: %+v", p.DownloadUrl, chunk.startOffset, chunk.endOffset, err)
-						time.Sleep(1 * time.Second)
-						resp = nil
-						continue
-					}
-					if !strings.HasPrefix(resp.Status(), "20") {
-						logrus.Debugf("处理 %+v 链接 range=%d-%d 部分失败, statusCode: %+v: %s", p.DownloadUrl, chunk.startOffset, chunk.endOffset, resp.StatusCode(), resp.String())
-						resp = nil
-						p.ProxyStop()
-						return
-					}
-					break
-				}
+	p.rateMutex.Lock()
+	chunkRate := p.ChunkRate
+	p.rateMutex.Unlock()
+	rate := float64(chunk.filledBytes()) / elapsed.Seconds()
+	if chunkRate <= 0 || rate*hedgeSlowFactor >= chunkRate {
+		return
+	}
 
-				if err != nil {
-					resp = nil
-					p.ProxyStop()
-					return
-				}
+	chunk.mutex.Lock()
+	chunk.hedged = true
+	chunk.mutex.Unlock()
+	logrus.Debugf("分块 %d-%d 下载速度 %.0f KB/s 远低于平均 %.0f KB/s, 发出对冲请求", chunk.startOffset, chunk.endOffset, rate/1024, chunkRate/1024)
+
+	go func() {
+		ctx, cancel := chunk.startFetch(p.ctx)
+		defer cancel()
+		chunk.allocate(!chunkCache.Enabled())
+		if p.streamRange(ctx, p.HedgeClient, req, chunk, chunk.startOffset, chunk.endOffset) == nil && ctx.Err() == nil {
+			logrus.Debugf("分块 %d-%d 对冲请求先完成", chunk.startOffset, chunk.endOffset)
+		}
+	}()
+}
 
-				// 接收数据
-				if resp != nil && resp.Body() != nil {
-					buffer := make([]byte, chunk.endOffset-chunk.startOffset+1)
-					copy(buffer, resp.Body())
-					chunk.put(buffer)
-				}
-				resp = nil
-				break
+// recordChunkRate 记录分块下载速度的滑动平均值, 作为判断分块是否落后的依据
+func (p *ProxyDownloadStruct) recordChunkRate(size int64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+	p.rateMutex.Lock()
+	defer p.rateMutex.Unlock()
+	if p.ChunkRate <= 0 {
+		p.ChunkRate = rate
+	} else {
+		p.ChunkRate = p.ChunkRate*0.8 + rate*0.2
+	}
+}
+
+// loadChunk 下载分块数据, 磁盘缓存中已有的部分直接读取, 缺失的部分从源站下载后补全
+// 数据边下载边写入分块供读取方使用, 返回的完整数据可能被共享, 不可修改
+func (p *ProxyDownloadStruct) loadChunk(ctx context.Context, req *http.Request, chunk *Chunk) ([]byte, error) {
+	// 数据会写入共享缓存时不使用缓冲池
+	chunk.allocate(!chunkCache.Enabled())
+
+	missing := [][2]int64{{chunk.startOffset, chunk.endOffset}}
+	if diskCache != nil {
+		chunk.load(func(buffer []byte) {
+			missing = diskCache.ReadRange(p.DownloadUrl, p.Validator, chunk.startOffset, chunk.endOffset, buffer)
+		})
+	}
+	for _, gap := range missing {
+		chunk.advance(gap[0] - chunk.startOffset)
+		if err := p.streamRange(ctx, p.Client, req, chunk, gap[0], gap[1]); err != nil {
+			if chunk.isDone() {
+				// 对冲请求先完成, 本次请求已被取消
+				return chunk.data(), nil
+			}
+			return nil, err
+		}
+		if diskCache != nil {
+			diskCache.WriteRange(p.DownloadUrl, p.Validator, gap[0], chunk.data()[gap[0]-chunk.startOffset:gap[1]-chunk.startOffset+1])
+		}
+	}
+	chunk.advance(chunk.size())
+	return chunk.data(), nil
+}
+
+// streamRange 下载 [startOffset, endOffset] 区间的数据并边接收边写入分块
+// 失败时按次数重试, 重试时从分块已写入的位置继续
+func (p *ProxyDownloadStruct) streamRange(ctx context.Context, client *resty.Client, req *http.Request, chunk *Chunk, startOffset int64, endOffset int64) error {
+	newHeader := make(map[string][]string)
+	for key, value := range req.Header {
+		if !shouldFilterHeaderName(key) {
+			newHeader[key] = value
+		}
+	}
+
+	maxRetries := 5
+	if startOffset < int64(1048576) || (p.EndOffset-startOffset)/p.EndOffset*1000 < 2 {
+		maxRetries = 7
+	}
+
+	var resp *resty.Response
+	var err error
+	for retry := 0; retry < maxRetries; retry++ {
+		offset := max(startOffset, chunk.startOffset+chunk.filledBytes())
+		if offset > endOffset {
+			return nil
+		}
+
+		// 建立连接, 配置了代理池时每次请求分配一个代理
+		requestTime := time.Now()
+		rangeStr := fmt.Sprintf("bytes=%d-%d", offset, endOffset)
+		proxyCtx, releaseProxy := base.AcquireUpstreamProxy(ctx, p.DownloadUrl)
+		resp, err = client.R().
+			SetContext(proxyCtx).
+			SetDoNotParseResponse(true).
+			SetHeaderMultiValues(newHeader).
+			SetHeader("Range", rangeStr).
+			Get(p.DownloadUrl)
+
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.RawBody().Close()
+			}
+			releaseProxy(false)
+			return ctx.Err()
+		}
+		if err != nil {
+			logrus.Errorf("处理 %+v 链接 range=%d-%d 部分失败: %+v", p.DownloadUrl, offset, endOffset, err)
+			releaseProxy(true)
+			p.ThrottledCount.Add(1)
+			resp = nil
+			if !sleepContext(ctx, 1*time.Second) {
+				return ctx.Err()
+			}
+			continue
+		}
+		if resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() == http.StatusServiceUnavailable {
+			// 源站限流, 稍后重试
+			logrus.Debugf("处理 %+v 链接 range=%d-%d 部分被限流, statusCode: %+v", p.DownloadUrl, offset, endOffset, resp.StatusCode())
+			resp.RawBody().Close()
+			releaseProxy(false)
+			p.ThrottledCount.Add(1)
+			err = fmt.Errorf("statusCode: %d", resp.StatusCode())
+			resp = nil
+			if !sleepContext(ctx, time.Duration(retry+1)*time.Second) {
+				return ctx.Err()
+			}
+			continue
+		}
+		if !strings.HasPrefix(resp.Status(), "20") {
+			bodyBytes, _ := io.ReadAll(io.LimitReader(resp.RawBody(), 4096))
+			resp.RawBody().Close()
+			releaseProxy(resp.StatusCode() == http.StatusProxyAuthRequired)
+			logrus.Debugf("处理 %+v 链接 range=%d-%d 部分失败, statusCode: %+v: %s", p.DownloadUrl, offset, endOffset, resp.StatusCode(), string(bodyBytes))
+			return fmt.Errorf("statusCode: %d", resp.StatusCode())
+		}
+
+		// 源站未按 Range 返回数据时分块无法拼接, 记录该源站并中止会话, 之后的请求以单线程转发
+		if err = checkRangeResponse(resp.StatusCode(), resp.Header().Get("Content-Range"), offset, endOffset, p.Validator.Size); err != nil {
+			resp.RawBody().Close()
+			releaseProxy(false)
+			logrus.Errorf("处理 %+v 链接时源站忽略了 Range 请求, 中止会话: %+v", p.DownloadUrl, err)
+			markRangeUnsupported(p.DownloadUrl)
+			mediaCache.Delete(p.DownloadUrl + "#Headers")
+			p.ProxyStop()
+			return err
+		}
+
+		// 源站文件在会话中途发生变化时中止会话, 避免拼接两个不同的文件
+		if err = p.checkValidator(resp.Header()); err != nil {
+			resp.RawBody().Close()
+			releaseProxy(false)
+			logrus.Errorf("处理 %+v 链接 range=%d-%d 部分时源站文件已变化, 中止会话: %+v", p.DownloadUrl, offset, endOffset, err)
+			mediaCache.Delete(p.DownloadUrl + "#Headers")
+			p.ProxyStop()
+			return err
+		}
+
+		// 接收数据
+		if resp.RawResponse.ContentLength >= 0 && resp.RawResponse.ContentLength != endOffset-offset+1 {
+			err = fmt.Errorf("数据长度 %d 与请求长度 %d 不符", resp.RawResponse.ContentLength, endOffset-offset+1)
+		} else {
+			err = p.receive(resp.RawBody(), chunk, offset)
+		}
+		resp.RawBody().Close()
+		resp = nil
+		releaseProxy(err != nil && ctx.Err() == nil)
+		if chunk.startOffset+chunk.filledBytes() > endOffset {
+			if err == nil {
+				p.recordChunkRate(endOffset-offset+1, time.Since(requestTime))
+				p.adaptChunkSize(endOffset-offset+1, time.Since(requestTime))
 			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
 		}
+		logrus.Errorf("处理 %+v 链接 range=%d-%d 部分失败: %+v", p.DownloadUrl, offset, endOffset, err)
 	}
+	return err
 }
 
-func (p *ProxyDownloadStruct) GetRemainingSize(bufferSize int64) int64 {
-	p.ProxyMutex.Lock()
-	defer p.ProxyMutex.Unlock()
-	return int64(len(p.ReadyChunkQueue)) * bufferSize
+// streamIgnoringRange 源站忽略 Range 时以单线程请求完整文件, 跳过 start 之前的数据后写出 [start, end] 区间
+func (p *ProxyDownloadStruct) streamIgnoringRange(req *http.Request, out io.Writer, start int64, end int64) error {
+	body, err := p.openIgnoringRange(req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := io.CopyN(io.Discard, body, start); err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, body, end-start+1)
+	return err
+}
+
+// openIgnoringRange 不带 Range 请求完整文件, 返回从文件开头读取的响应体
+func (p *ProxyDownloadStruct) openIgnoringRange(req *http.Request) (io.ReadCloser, error) {
+	newHeader := make(map[string][]string)
+	for key, value := range req.Header {
+		if !shouldFilterHeaderName(key) {
+			newHeader[key] = value
+		}
+	}
+	resp, err := base.SessionClient(base.RestyClientWithProxy, p.CookieJar, 0, 1).
+		R().
+		SetContext(req.Context()).
+		SetDoNotParseResponse(true).
+		SetHeaderMultiValues(newHeader).
+		Get(p.DownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		resp.RawBody().Close()
+		return nil, fmt.Errorf("statusCode: %d", resp.StatusCode())
+	}
+	if err := p.checkValidator(resp.Header()); err != nil {
+		resp.RawBody().Close()
+		return nil, err
+	}
+	return resp.RawBody(), nil
+}
+
+// checkValidator 检查分块响应的 ETag、Last-Modified 与文件大小是否与会话开始时一致
+func (p *ProxyDownloadStruct) checkValidator(header http.Header) error {
+	etag := header.Get("ETag")
+	if p.Validator.ETag != "" && etag != "" && strings.TrimPrefix(etag, "W/") != strings.TrimPrefix(p.Validator.ETag, "W/") {
+		return fmt.Errorf("ETag 由 %s 变为 %s", p.Validator.ETag, etag)
+	}
+	lastModified := header.Get("Last-Modified")
+	if p.Validator.LastModified != "" && lastModified != "" && lastModified != p.Validator.LastModified {
+		return fmt.Errorf("Last-Modified 由 %s 变为 %s", p.Validator.LastModified, lastModified)
+	}
+	size := contentRangeSize(header.Get("Content-Range"))
+	if p.Validator.Size > 0 && size >= 0 && size != p.Validator.Size {
+		return fmt.Errorf("文件大小由 %d 变为 %d", p.Validator.Size, size)
+	}
+	return nil
+}
+
+// receive 读取响应体并从 offset 开始写入分块
+func (p *ProxyDownloadStruct) receive(body io.Reader, chunk *Chunk, offset int64) error {
+	scratch := base.GetBuffer(32 * 1024)
+	defer base.PutBuffer(scratch)
+	pos := offset - chunk.startOffset
+	for {
+		n, err := body.Read(scratch)
+		if n > 0 {
+			p.DownloadedBytes.Add(int64(n))
+			chunk.writeAt(pos, scratch[:n])
+			pos += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *ProxyDownloadStruct) GetRemainingSize() int64 {
+	return p.QueuedBytes.Load()
+}
+
+// adaptChunkSize 根据分块下载耗时调整后续分块大小
+// 下载较快且客户端已读取足够数据时加倍, 下载较慢时减半, 使起播和拖动后首个分块尽量小
+func (p *ProxyDownloadStruct) adaptChunkSize(size int64, elapsed time.Duration) {
+	p.rateMutex.Lock()
+	defer p.rateMutex.Unlock()
+	if size < p.ChunkSize {
+		// 首尾不完整的分块不具有参考价值
+		return
+	}
+	readBytes := p.CurrentOffset.Load() - p.startOffset
+	switch {
+	case elapsed < fastChunkDuration && p.ChunkSize < p.MaxChunkSize && readBytes >= p.ChunkSize*2:
+		p.ChunkSize = min(p.ChunkSize*2, p.MaxChunkSize)
+		logrus.Debugf("分块下载耗时 %v, 分块大小增加至 %d", elapsed, p.ChunkSize)
+	case elapsed > slowChunkDuration && p.ChunkSize > p.MinChunkSize:
+		p.ChunkSize = max(p.ChunkSize/2, p.MinChunkSize)
+		logrus.Debugf("分块下载耗时 %v, 分块大小减少至 %d", elapsed, p.ChunkSize)
+	}
 }
 
 func handleMethod(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
-	case http.MethodGet:
-		// 处理 GET 请求
-		logrus.Info("正在 GET 请求")
+	case http.MethodGet, http.MethodHead:
+		// 处理 GET 请求, HEAD 请求与 GET 共用探测结果, 只返回响应头
+		logrus.Infof("正在 %v 请求", req.Method)
+		// 查看DNS服务器状态
+		if req.URL.Path == "/dns" {
+			handleDNSStatus(w, req)
+			return
+		}
 		// 检查查询参数是否为空
 		if req.URL.RawQuery == "" {
 			// 获取嵌入的 index.html 文件
@@ -384,6 +1018,18 @@ func handleMethod(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handleDNSStatus 返回各上游DNS服务器的测速结果及当前使用的服务器
+func handleDNSStatus(w http.ResponseWriter, req *http.Request) {
+	data, err := json.MarshalIndent(base.DNSStatus(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
 func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 	pw := bufio.NewWriterSize(w, 128*1024)
 	defer func() {
@@ -414,7 +1060,7 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if strHeader != "" {
-		if strForm == "base64" {
+		if strForm == "base64" || strForm == "base64header" {
 			bytesStrHeader, err := base64.StdEncoding.DecodeString(strHeader)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("无效的Base64 Headers: %v", err), http.StatusBadRequest)
@@ -443,7 +1089,7 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 	newHeader["Host"] = []string{parsedURL.Host}
 
 	for parameterName := range query {
-		if parameterName == "url" || parameterName == "form" || parameterName == "thread" || parameterName == "size" || parameterName == "header" {
+		if parameterName == "url" || parameterName == "form" || parameterName == "thread" || parameterName == "size" || parameterName == "header" || parameterName == "live" {
 			continue
 		}
 		url = url + "&" + parameterName + "=" + query.Get(parameterName)
@@ -457,17 +1103,21 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		jar.SetCookies(u, cookies)
 	}
 
+	// HLS 播放列表、DASH 清单需要改写其中的地址
+	if isHLSPlaylist(url, "") {
+		handleHLSPlaylist(w, req, url, newHeader, jar)
+		return
+	}
+	if isDASHManifest(url, "") {
+		handleDASHManifest(w, req, url, newHeader, jar)
+		return
+	}
+
 	var statusCode int
 	var rangeStart, rangeEnd = int64(0), int64(0)
-	requestRange := req.Header.Get("Range")
-	rangeRegex := regexp.MustCompile(`bytes= *([0-9]+) *- *([0-9]*)`)
-	matchGroup := rangeRegex.FindStringSubmatch(requestRange)
-	if matchGroup != nil {
+	ranges := parseRangeHeader(req.Header.Get("Range"))
+	if len(ranges) > 0 {
 		statusCode = 206
-		rangeStart, _ = strconv.ParseInt(matchGroup[1], 10, 64)
-		if len(matchGroup) > 2 {
-			rangeEnd, _ = strconv.ParseInt(matchGroup[2], 10, 64)
-		}
 	} else {
 		statusCode = 200
 	}
@@ -476,24 +1126,65 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 	headersKey := url + "#Headers"
 	var responseHeaders interface{}
 	var connection = "keep-alive"
+	revalidatedKey := url + "#Revalidated"
 	responseHeaders, found := mediaCache.Get(headersKey)
-	if !found {
-		// 关闭 Idle 超时设置
-		base.IdleConnTimeout = 0
-		resp, err := base.RestyClient.
-			SetTimeout(0).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
-			SetDoNotParseResponse(true).
-			SetOutput(os.DevNull).
-			SetHeaderMultiValues(newHeader).
-			SetHeader("Range", "bytes=0-1023").
-			Get(url)
+	if found {
+		// 超过 headersRevalidateInterval 未向源站确认的 Headers 需重新验证
+		if _, revalidated := mediaCache.Get(revalidatedKey); !revalidated {
+			if revalidateHeaders(req, url, newHeader, jar, responseHeaders.(http.Header)) {
+				mediaCache.Set(revalidatedKey, true, headersRevalidateInterval)
+			} else {
+				logrus.Infof("源站文件 %v 已变化, 重新获取 Headers", url)
+				mediaCache.Delete(headersKey)
+				found = false
+			}
+		}
+	}
+	if found {
+		// 缓存的 Headers 由多个请求共享, 复制后再修改
+		responseHeaders = responseHeaders.(http.Header).Clone()
+		if notModified(req, responseHeaders.(http.Header)) {
+			writeNotModified(w, responseHeaders.(http.Header))
+			return
+		}
+	} else {
+		// 已知忽略 Range 请求的源站不再请求范围, 直接以单线程转发
+		probeRange := !rangeUnsupported(url)
+		newProbe := func(withRange bool) *resty.Request {
+			probe := base.SessionClient(base.RestyClientWithProxy, jar, 0, 3).
+				R().
+				SetContext(req.Context()).
+				SetDoNotParseResponse(true).
+				SetOutput(os.DevNull).
+				SetHeaderMultiValues(newHeader)
+			if withRange {
+				probe.SetHeader("Range", "bytes=0-1023")
+			}
+			return probe
+		}
+		resp, err := newProbe(probeRange).Get(url)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("下载 %v 链接失败: %v", url, err), http.StatusInternalServerError)
 			return
 		}
+		// 源站返回 206 但 Content-Range 缺失、与请求不符或文件大小未知时无法分块下载
+		// 响应体只是文件的一部分, 不能作为完整内容转发, 不带 Range 重新请求
+		if probeStart, _, probeSize, ok := parseContentRange(resp.Header().Get("Content-Range")); probeRange && resp.StatusCode() == http.StatusPartialContent && (!ok || probeStart != 0 || probeSize < 0) {
+			logrus.Infof("源站 %v 返回的 Content-Range %q 无法用于分块下载, 不带 Range 重新请求", url, resp.Header().Get("Content-Range"))
+			resp.RawBody().Close()
+			markRangeUnsupported(url)
+			probeRange = false
+			resp, err = newProbe(false).Get(url)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("下载 %v 链接失败: %v", url, err), http.StatusBadGateway)
+				return
+			}
+			if resp.StatusCode() != http.StatusOK {
+				resp.RawBody().Close()
+				http.Error(w, fmt.Sprintf("不带 Range 请求 %v 时源站返回了 %d", url, resp.StatusCode()), http.StatusBadGateway)
+				return
+			}
+		}
 		if resp.StatusCode() < 200 || resp.StatusCode() >= 400 {
 			defer resp.RawBody().Close()
 			bodyBytes, _ := io.ReadAll(resp.RawBody())
@@ -501,7 +1192,22 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, bodyString, resp.StatusCode())
 			return
 		}
+		if isHLSPlaylist(url, resp.Header().Get("Content-Type")) {
+			resp.RawBody().Close()
+			handleHLSPlaylist(w, req, url, newHeader, jar)
+			return
+		}
+		if isDASHManifest(url, resp.Header().Get("Content-Type")) {
+			resp.RawBody().Close()
+			handleDASHManifest(w, req, url, newHeader, jar)
+			return
+		}
 		responseHeaders = resp.Header()
+		if notModified(req, responseHeaders.(http.Header)) {
+			resp.RawBody().Close()
+			writeNotModified(w, responseHeaders.(http.Header))
+			return
+		}
 
 		var fileName string
 		contentDisposition := strings.ToLower(responseHeaders.(http.Header).Get("Content-Disposition"))
@@ -548,6 +1254,18 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			responseHeaders.(http.Header).Set("Content-Type", contentType)
 		}
 
+		// 源站声明支持断点续传却未按 Range 返回数据时按不支持处理
+		// 文件不足 1024 字节时源站返回 200 是正常的, 此时不记录该源站
+		probeStart, _, _, ok := parseContentRange(responseHeaders.(http.Header).Get("Content-Range"))
+		if !probeRange || resp.StatusCode() != http.StatusPartialContent || !ok || probeStart != 0 {
+			if probeRange && (resp.RawResponse.ContentLength < 0 || resp.RawResponse.ContentLength > 1024) {
+				logrus.Infof("源站 %v 忽略了 Range 请求, 改为单线程转发", url)
+				markRangeUnsupported(url)
+			}
+			responseHeaders.(http.Header).Del("Content-Range")
+			responseHeaders.(http.Header).Del("Accept-Ranges")
+		}
+
 		contentRange := responseHeaders.(http.Header).Get("Content-Range")
 		if contentRange != "" {
 			matchGroup := regexp.MustCompile(`.*/([0-9]+)`).FindStringSubmatch(contentRange)
@@ -564,38 +1282,16 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 
 		acceptRange := responseHeaders.(http.Header).Get("Accept-Ranges")
 		if contentRange == "" && acceptRange == "" {
-			// 不支持断点续传
+			// 不支持断点续传, 以单线程转发
 			logrus.Debug("不支持断点续传")
-			buf := make([]byte, 1024*64)
-			for {
-				n, err := resp.RawBody().Read(buf)
-				if n > 0 {
-					// 写入数据到客户端
-					_, writeErr := pw.Write(buf[:n])
-					if writeErr != nil {
-						http.Error(w, fmt.Sprintf("向客户端写入 Response 失败: %v", writeErr), http.StatusInternalServerError)
-						return
-					}
-				}
-				if err != nil {
-					if err != io.EOF {
-						logrus.Errorf("读取 Response Body 错误: %v", err)
-					}
-					break
-				}
-			}
 			responseHeaders.(http.Header).Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", fileName))
-
-			defer func() {
-				if resp != nil && resp.RawBody() != nil {
-					logrus.Debugf("resp.RawBody 已关闭")
-					resp.RawBody().Close()
-				}
-			}()
+			servePassthrough(w, req, url, newHeader, jar, resp, responseHeaders.(http.Header))
+			return
 		} else {
 			// 支持断点续传
 			logrus.Debug("支持断点续传")
-			mediaCache.Set(headersKey, responseHeaders, 14400*time.Second)
+			mediaCache.Set(headersKey, responseHeaders.(http.Header).Clone(), 14400*time.Second)
+			mediaCache.Set(revalidatedKey, true, headersRevalidateInterval)
 
 			if resp != nil && resp.RawBody() != nil {
 				logrus.Debugf("resp.RawBody 已关闭")
@@ -609,6 +1305,8 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 	if contentRange == "" && acceptRange == "" {
 		// 不支持断点续传
 		logrus.Debug("不支持断点续传-从缓存获取Headers")
+		// 返回完整内容, 忽略客户端的 Range
+		statusCode = 200
 		for key, values := range responseHeaders.(http.Header) {
 			if strings.EqualFold(strings.ToLower(key), "connection") || strings.EqualFold(strings.ToLower(key), "proxy-connection") {
 				continue
@@ -623,19 +1321,40 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		responseHeaders.(http.Header).Del("Content-Range")
 		responseHeaders.(http.Header).Set("Accept-Ranges", "bytes")
 
-		var splitSize int64
+		var splitSize, maxSplitSize int64
 		var numTasks int64
 
 		contentSize := int64(0)
-		matchGroup = regexp.MustCompile(`.*/([0-9]+)`).FindStringSubmatch(contentRange)
+		matchGroup := regexp.MustCompile(`.*/([0-9]+)`).FindStringSubmatch(contentRange)
 		if matchGroup != nil {
 			contentSize, _ = strconv.ParseInt(matchGroup[1], 10, 64)
 		} else {
 			contentSize, _ = strconv.ParseInt(responseHeaders.(http.Header).Get("Content-Length"), 10, 64)
 		}
 
-		if rangeEnd == int64(0) {
-			rangeEnd = contentSize - 1
+		// If-Range 与源站文件不一致时忽略 Range, 返回完整内容
+		if len(ranges) > 0 && !ifRangeMatches(req.Header.Get("If-Range"), responseHeaders.(http.Header)) {
+			logrus.Debugf("If-Range 与源站文件不一致, 返回完整内容")
+			ranges = nil
+			statusCode = 200
+		}
+		rangeEnd = contentSize - 1
+		if len(ranges) > 0 {
+			ranges = satisfiableRanges(ranges, contentSize)
+			if len(ranges) == 0 {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentSize))
+				http.Error(w, "请求的范围无法满足", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			// 合并重叠或相邻的范围, 合并后仍过多时返回完整内容, 避免一个请求放大成多次源站下载
+			ranges = coalesceRanges(ranges)
+			if len(ranges) > maxMultipartRanges {
+				logrus.Debugf("请求了 %d 个不相邻的范围, 超过 %d 个, 返回完整内容", len(ranges), maxMultipartRanges)
+				ranges = nil
+				statusCode = 200
+			} else {
+				rangeStart, rangeEnd = ranges[0].start, ranges[0].end
+			}
 		}
 		if rangeStart < contentSize {
 			if strThread == "" {
@@ -655,13 +1374,37 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			if numTasks <= 0 {
 				numTasks = 1
 			}
+			if adaptiveThread {
+				numTasks = max(minThread, min(numTasks, maxThread))
+			}
 
+			// size 参数为单个值时固定分块大小, 为 "最小-最大" 时限定分块大小的调整范围
+			splitSize, maxSplitSize = minChunkSize, maxChunkSize
 			if strSplitSize != "" {
-				splitSize, _ = strconv.ParseInt(strSplitSize, 10, 64)
-			} else {
-				splitSize = int64(128 * 1024)
+				bounds := strings.SplitN(strSplitSize, "-", 2)
+				splitSize, _ = strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64)
+				maxSplitSize = splitSize
+				if len(bounds) == 2 {
+					maxSplitSize, _ = strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 64)
+				}
+			}
+			if splitSize <= 0 {
+				splitSize = minChunkSize
+			}
+			if maxSplitSize < splitSize {
+				maxSplitSize = splitSize
+			}
+			validator := base.CacheValidator{
+				ETag:         responseHeaders.(http.Header).Get("ETag"),
+				LastModified: responseHeaders.(http.Header).Get("Last-Modified"),
+				Size:         contentSize,
+			}
+			if len(ranges) > 1 {
+				serveMultipartRanges(w, pw, req, url, responseHeaders.(http.Header), ranges, contentSize, numTasks, splitSize, maxSplitSize, jar, validator)
+				return
 			}
 			responseHeaders.(http.Header).Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rangeStart, rangeEnd, contentSize))
+			responseHeaders.(http.Header).Set("Content-Length", strconv.FormatInt(rangeEnd-rangeStart+1, 10))
 
 			for key, values := range responseHeaders.(http.Header) {
 				if strings.EqualFold(strings.ToLower(key), "connection") || strings.EqualFold(strings.ToLower(key), "proxy-connection") || strings.EqualFold(strings.ToLower(key), "transfer-encoding") {
@@ -680,15 +1423,26 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 				w.Header().Set("Connection", "keep-alive")
 			}
 			w.WriteHeader(statusCode)
+			if req.Method == http.MethodHead {
+				return
+			}
 
 			rp, wp := io.Pipe()
 			emitter := base.NewEmitter(rp, wp)
 
 			maxChunks := int64(128*1024*1024) / splitSize
-			p := newProxyDownloadStruct(url, proxyTimeout, maxChunks, splitSize, rangeStart, rangeEnd, numTasks, jar, runtime.NumGoroutine()+1)
+			p := newProxyDownloadStruct(req.Context(), url, proxyTimeout, maxChunks, splitSize, maxSplitSize, rangeStart, rangeEnd, numTasks, jar, runtime.NumGoroutine()+1, validator)
 
 			go ConcurrentDownload(p, url, rangeStart, rangeEnd, splitSize, numTasks, emitter, req, jar)
-			io.Copy(pw, emitter)
+			written, _ := io.Copy(pw, emitter)
+			if written < rangeEnd-rangeStart+1 && rangeUnsupported(url) {
+				// 分块下载中发现源站忽略 Range, 剩余部分改为单线程转发
+				logrus.Infof("源站 %v 忽略了 Range 请求, 剩余部分改为单线程转发", url)
+				pw.Flush()
+				if err := p.streamIgnoringRange(req, w, rangeStart+written, rangeEnd); err != nil {
+					logrus.Errorf("单线程转发 %v 失败: %v", url, err)
+				}
+			}
 
 			defer func() {
 				logrus.Debugf("handleGetMethod emitter 已关闭-支持断点续传")
@@ -742,7 +1496,7 @@ func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 	// 处理自定义 header
 	var header map[string]string
 	if strHeader != "" {
-		if strForm == "base64" {
+		if strForm == "base64" || strForm == "base64header" {
 			bytesStrHeader, err := base64.StdEncoding.DecodeString(strHeader)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("无效的Base64 Headers: %v", err), http.StatusBadRequest)
@@ -788,59 +1542,32 @@ func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 		reqBody, _ = io.ReadAll(req.Body)
 	}
 
+	client := base.SessionClient(base.RestyClientWithProxy, jar, 10*time.Second, 3)
 	var resp *resty.Response
 	var err error
 	switch req.Method {
 	case http.MethodPost:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
+		resp, err = client.R().
 			SetBody(reqBody).
 			SetHeaderMultiValues(newHeader).
 			Post(url)
 	case http.MethodPut:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
+		resp, err = client.R().
 			SetBody(reqBody).
 			SetHeaderMultiValues(newHeader).
 			Put(url)
 	case http.MethodOptions:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
+		resp, err = client.R().
 			SetHeaderMultiValues(newHeader).
 			Options(url)
 	case http.MethodDelete:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
+		resp, err = client.R().
 			SetHeaderMultiValues(newHeader).
 			Delete(url)
 	case http.MethodPatch:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
+		resp, err = client.R().
 			SetHeaderMultiValues(newHeader).
 			Patch(url)
-	case http.MethodHead:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
-			SetHeaderMultiValues(newHeader).
-			Head(url)
 	default:
 		http.Error(w, fmt.Sprintf("无效的Method: %v", req.Method), http.StatusBadRequest)
 	}
@@ -871,7 +1598,7 @@ func shouldFilterHeaderName(key string) bool {
 		return false
 	}
 	key = strings.ToLower(key)
-	return key == "range" || key == "host" || key == "http-client-ip" || key == "remote-addr" || key == "accept-encoding"
+	return key == "range" || key == "if-range" || key == "if-none-match" || key == "if-modified-since" || key == "host" || key == "http-client-ip" || key == "remote-addr" || key == "accept-encoding"
 }
 
 func checkFileExists(path string) error {
@@ -882,59 +1609,6 @@ func checkFileExists(path string) error {
     return err
 }
 
-type DNSServer struct {
-	Address string
-	Latency time.Duration
-}
-
-// 测试 DNS 服务器响应速度
-func measureDNS(server string, domain string) (time.Duration, error) {
-	client := new(dns.Client)
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-
-	start := time.Now()
-	_, _, err := client.Exchange(msg, net.JoinHostPort(server, "53"))
-	if err != nil {
-		return 0, err
-	}
-	return time.Since(start), nil
-}
-
-// 选择最快 DNS 服务器
-func FindFastestDNS(servers []string, domain string) string {
-	results := make(chan DNSServer, len(servers))
-	var wg sync.WaitGroup
-
-	for _, srv := range servers {
-		wg.Add(1)
-		go func(server string) {
-			defer wg.Done()
-			latency, err := measureDNS(server, domain)
-			if err == nil {
-				results <- DNSServer{server, latency}
-			}
-		}(srv)
-	}
-
-	wg.Wait()
-	close(results)
-
-	var serverList []DNSServer
-	for res := range results {
-		serverList = append(serverList, res)
-	}
-
-	sort.Slice(serverList, func(i, j int) bool {
-		return serverList[i].Latency < serverList[j].Latency
-	})
-
-	if len(serverList) > 0 {
-		return serverList[0].Address
-	}
-	return ""
-}
-
 func loadConfig(cfg *Config) error {
     // 优先级：命令行参数 > 环境变量
     path := flag.String("config", os.Getenv("CONFIG_PATH"), "外部配置文件路径")
@@ -975,6 +1649,63 @@ func main() {
 	} else {
 		workPool = false // 默认值
 	}
+	// 设置自适应线程数
+	if config.AdaptiveThread != nil && config.AdaptiveThread.Enable != nil && *config.AdaptiveThread.Enable {
+		adaptiveThread = true
+		if config.AdaptiveThread.Min != nil && *config.AdaptiveThread.Min > 0 {
+			minThread = *config.AdaptiveThread.Min
+		}
+		if config.AdaptiveThread.Max != nil && *config.AdaptiveThread.Max >= minThread {
+			maxThread = *config.AdaptiveThread.Max
+		} else if maxThread < minThread {
+			maxThread = minThread
+		}
+		logrus.Infof("已开启自适应线程数: %d - %d", minThread, maxThread)
+	}
+	// 设置分块缓存, 单位 MB
+	if config.ChunkCache != nil && *config.ChunkCache > 0 {
+		chunkCache = base.NewChunkCache(*config.ChunkCache * 1024 * 1024)
+		logrus.Infof("已开启分块缓存: %d MB", *config.ChunkCache)
+	}
+	// 设置磁盘缓存, 单位 MB
+	if config.DiskCache != nil && config.DiskCache.Dir != nil && *config.DiskCache.Dir != "" {
+		maxSize := int64(10 * 1024)
+		if config.DiskCache.MaxSize != nil {
+			maxSize = *config.DiskCache.MaxSize
+		}
+		diskCache, err = base.NewDiskCache(*config.DiskCache.Dir, maxSize*1024*1024)
+		if err != nil {
+			logrus.Errorf("磁盘缓存初始化失败: %v", err)
+			diskCache = nil
+		}
+	}
+	// 设置上游代理
+	if config.UpstreamProxy != nil {
+		rules := make([]base.UpstreamProxyRule, 0, len(config.UpstreamProxy.Rules))
+		for _, rule := range config.UpstreamProxy.Rules {
+			rules = append(rules, base.UpstreamProxyRule{Match: rule.Match, Proxy: rule.Proxy})
+		}
+		pools := make(map[string]base.UpstreamProxyPool, len(config.UpstreamProxy.Pools))
+		for name, pool := range config.UpstreamProxy.Pools {
+			pools[name] = base.UpstreamProxyPool{Proxies: pool.Proxies, Strategy: pool.Strategy}
+		}
+		defaultProxy := base.DirectProxy
+		if config.UpstreamProxy.Default != nil {
+			defaultProxy = *config.UpstreamProxy.Default
+		}
+		if err := base.ConfigureUpstreamProxies(config.UpstreamProxy.Proxies, pools, rules, defaultProxy); err != nil {
+			logrus.Fatalf("上游代理配置无效: %v", err)
+		}
+		logrus.Infof("已配置 %d 个上游代理, %d 个代理池, %d 条代理规则, 默认: %s", len(config.UpstreamProxy.Proxies), len(pools), len(rules), defaultProxy)
+		go base.LogUpstreamProxyHealth(5 * time.Minute)
+	}
+	// 设置本机出口
+	if len(config.LocalAddress) > 0 {
+		if err := base.ConfigureLocalAddresses(config.LocalAddress); err != nil {
+			logrus.Fatalf("本机出口配置无效: %v", err)
+		}
+		logrus.Infof("已配置本机出口: %s", strings.Join(config.LocalAddress, ", "))
+	}
 	// 设置端口
 	port := "7779"
 	if config.Port != nil {
@@ -990,11 +1721,83 @@ func main() {
 			}
 		}
 	}
-	// 设置DNS
-	dnsResolver := *config.DNS
-	if dnsResolver == "" {
-		dnsResolver = FindFastestDNS([]string{"119.29.29.29", "180.76.76.76", "223.5.5.5", "114.114.114.114", "1.1.1.1", "101.226.4.6", "1.2.4.8", "210.2.4.8", "123.125.81.6"}, "baidu.com")
-		logrus.Infof("自动选择最快DNS: %s", dnsResolver)
+	// 设置DNS, 支持单个地址或按顺序回退的地址列表
+	var dnsResolvers []string
+	if config.DNS != nil {
+		var dnsValue string
+		if err := json.Unmarshal(config.DNS, &dnsValue); err == nil {
+			if dnsValue != "" {
+				dnsResolvers = []string{dnsValue}
+			}
+		} else if err := json.Unmarshal(config.DNS, &dnsResolvers); err != nil {
+			logrus.Errorf("警告: 无法解析DNS配置，将自动选择DNS")
+		}
+	}
+	dnsBenchmark := config.DNSBenchmark
+	if len(dnsResolvers) == 0 {
+		// 未配置DNS时从候选列表中自动选择最快的DNS
+		dnsResolvers = []string{"119.29.29.29", "180.76.76.76", "223.5.5.5", "114.114.114.114", "1.1.1.1", "101.226.4.6", "1.2.4.8", "210.2.4.8", "123.125.81.6"}
+		if dnsBenchmark == nil {
+			dnsBenchmark = &DNSBenchmarkConfig{}
+		}
+	}
+	if err := base.ConfigureDNS(dnsResolvers); err != nil {
+		logrus.Fatalf("DNS配置无效: %v", err)
+	}
+	// 定期测速DNS并按耗时排序, 单位秒
+	if dnsBenchmark != nil {
+		interval, domain := int64(600), "baidu.com"
+		if dnsBenchmark.Interval != nil {
+			interval = *dnsBenchmark.Interval
+		}
+		if dnsBenchmark.Domain != nil && *dnsBenchmark.Domain != "" {
+			domain = *dnsBenchmark.Domain
+		}
+		base.StartDNSBenchmark(domain, time.Duration(interval)*time.Second)
+		logrus.Infof("自动选择最快DNS: %s, 每 %d 秒重新测速", base.DNSStatus()[0].Server, interval)
+	}
+	// 设置DNS缓存, 单位秒
+	if config.DNSCache != nil {
+		minTTL, maxTTL := int64(30), int64(3600)
+		if config.DNSCache.MinTTL != nil {
+			minTTL = *config.DNSCache.MinTTL
+		}
+		if config.DNSCache.MaxTTL != nil {
+			maxTTL = *config.DNSCache.MaxTTL
+		}
+		base.ConfigureDNSCache(time.Duration(minTTL)*time.Second, time.Duration(maxTTL)*time.Second)
+		logrus.Infof("已开启DNS缓存, TTL: %d - %d 秒", minTTL, maxTTL)
+		if config.DNSCache.FastestIP != nil && *config.DNSCache.FastestIP {
+			base.EnableFastestIP()
+			logrus.Info("已开启按连接耗时选择IP")
+		}
+	}
+	// 设置静态解析, 多个IP以逗号分隔
+	if len(config.Hosts) > 0 {
+		hosts := make(map[string][]string, len(config.Hosts))
+		for host, ips := range config.Hosts {
+			hosts[host] = strings.Split(ips, ",")
+		}
+		if err := base.ConfigureHosts(hosts); err != nil {
+			logrus.Fatalf("hosts配置无效: %v", err)
+		}
+		logrus.Infof("已配置 %d 条静态解析", len(hosts))
+	}
+
+	// 设置源站证书验证, 默认不验证
+	if config.TLS != nil {
+		domains := make(map[string]base.TLSPolicy, len(config.TLS.Domains))
+		for domain, policy := range config.TLS.Domains {
+			domains[domain] = base.TLSPolicy{Verify: policy.Verify, Pins: policy.Pins, ClientCert: policy.ClientCert, ClientKey: policy.ClientKey, Fingerprint: policy.Fingerprint, Protocol: policy.Protocol}
+		}
+		global := base.TLSPolicy{Verify: config.TLS.Verify, Pins: config.TLS.Pins, ClientCert: config.TLS.ClientCert, ClientKey: config.TLS.ClientKey, Fingerprint: config.TLS.Fingerprint, Protocol: config.TLS.Protocol}
+		if err := base.ConfigureTLS(global, config.TLS.CAFiles, domains); err != nil {
+			logrus.Fatalf("TLS配置无效: %v", err)
+		}
+		logrus.Infof("已配置源站证书验证: 全局验证 %v, %d 个域名规则, %d 个CA证书文件", config.TLS.Verify != nil && *config.TLS.Verify, len(domains), len(config.TLS.CAFiles))
+		if config.TLS.Fingerprint != "" {
+			logrus.Infof("已开启TLS指纹模拟: %s", config.TLS.Fingerprint)
+		}
 	}
 
 	// 忽略 SIGPIPE 信号
@@ -1003,8 +1806,6 @@ func main() {
 	// 设置日志输出和级别
 	logrus.SetOutput(os.Stdout)
 
-	// 设置 DNS 解析器 IP
-	base.DnsResolverIP = dnsResolver + ":53"
 	base.InitClient()
 
 	// 设置http(s)服务器
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	handleUrl "net/url"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/bzsome/chaoGo/workpool"
+)
+
+// 会话结束后仍在工作池中排队的下载协程应直接退出, 不再访问已结束的会话
+func TestConcurrentDownloadQueuedWorkersAfterCancel(t *testing.T) {
+	base.InitClient()
+	savedWorkPool := workPool
+	workPool = true
+	defer func() {
+		workPool = savedWorkPool
+	}()
+
+	const url = "http://127.0.0.1:1/queued.bin"
+	const size = int64(1024 * 1024)
+	wp := workpool.New(1)
+	mediaCache.Set(url+"#Workpool", wp, time.Minute)
+	defer mediaCache.Delete(url + "#Workpool")
+
+	// 占满工作池, 使之后的下载协程都在队列中等待
+	release := make(chan struct{})
+	wp.Do(func() error {
+		<-release
+		return nil
+	})
+
+	sessions := make([]*ProxyDownloadStruct, 0, 30)
+	for i := 0; i < 30; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		if i%2 == 0 {
+			// 一半会话在开始前就被客户端取消
+			cancel()
+		}
+		p := newProxyDownloadStruct(ctx, url, 5, 4, 64*1024, 64*1024, 0, size-1, 4, nil, runtime.NumGoroutine(), base.CacheValidator{})
+		sessions = append(sessions, p)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ConcurrentDownload(p, url, 0, size-1, 64*1024, 4, base.NewEmitter(io.Pipe()), httptest.NewRequest("GET", "/", nil), nil)
+		}()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("第 %d 个会话取消后 ConcurrentDownload 未返回", i)
+		}
+	}
+
+	// 放行排队的协程, 工作池只有一个协程, 最后加入的任务执行时之前的任务都已执行完
+	finished := make(chan struct{})
+	wp.Do(func() error {
+		close(finished)
+		return nil
+	})
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("排队的下载协程未能及时退出")
+	}
+
+	for i, p := range sessions {
+		if active := p.ActiveWorkers.Load(); active != 0 {
+			t.Errorf("第 %d 个会话仍有 %d 个下载协程", i, active)
+		}
+		if p.NextChunkStartOffset != 0 {
+			t.Errorf("第 %d 个会话结束后仍生成了分块, NextChunkStartOffset = %d", i, p.NextChunkStartOffset)
+		}
+	}
+}
+
+// 并发的范围请求中途被客户端取消时, 其余请求仍应返回正确的数据
+func TestHandleMethodCancelledRangeRequests(t *testing.T) {
+	base.InitClient()
+	data := make([]byte, 4*1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		http.ServeContent(w, r, "data.bin", time.Unix(1700000000, 0), bytes.NewReader(data))
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(handleMethod))
+	defer proxy.Close()
+
+	link := proxy.URL + "/?thread=4&size=65536&url=" + handleUrl.QueryEscape(upstream.URL+"/data.bin")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start, end := int64(i*100000), int64(i*100000+1500000)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if i%2 == 1 {
+				time.AfterFunc(time.Duration(i)*time.Millisecond, cancel)
+			}
+			request, _ := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				if i%2 == 0 {
+					t.Errorf("请求 %d 失败: %v", i, err)
+				}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if i%2 == 1 {
+				return
+			}
+			if err != nil {
+				t.Errorf("读取请求 %d 失败: %v", i, err)
+				return
+			}
+			if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[start:end+1]) {
+				t.Errorf("请求 %d 返回 statusCode %d, %d 字节, 数据与源文件不一致", i, resp.StatusCode, len(body))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
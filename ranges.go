@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/textproto"
+	handleUrl "net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 合并后仍超过该数量的多范围请求忽略 Range, 返回完整内容
+const maxMultipartRanges = 16
+
+// 多范围请求中同时下载的范围数, 各范围平分请求的线程数与缓冲区
+const multipartParallelRanges = 4
+
+// httpRange 为 Range 请求头中的一个范围, end 为 -1 时表示到文件末尾
+// start 为 -1 时表示最后 end 个字节, 由 satisfiableRanges 按文件大小换算
+type httpRange struct {
+	start int64
+	end   int64
+}
+
+func (r httpRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRangeHeader 解析 "bytes=0-99, 500-, -500" 形式的 Range 请求头, 格式无效时返回 nil
+func parseRangeHeader(header string) []httpRange {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil
+	}
+	var ranges []httpRange
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		startText, endText, found := strings.Cut(spec, "-")
+		startText, endText = strings.TrimSpace(startText), strings.TrimSpace(endText)
+		if !found {
+			return nil
+		}
+		if startText == "" {
+			suffix, err := strconv.ParseInt(endText, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil
+			}
+			ranges = append(ranges, httpRange{start: -1, end: suffix})
+			continue
+		}
+		start, err := strconv.ParseInt(startText, 10, 64)
+		if err != nil || start < 0 {
+			return nil
+		}
+		end := int64(-1)
+		if endText != "" {
+			end, err = strconv.ParseInt(endText, 10, 64)
+			if err != nil || end < start {
+				return nil
+			}
+		}
+		ranges = append(ranges, httpRange{start: start, end: end})
+	}
+	return ranges
+}
+
+// satisfiableRanges 按文件大小确定各范围的起止位置, 去掉无法满足的范围
+func satisfiableRanges(ranges []httpRange, size int64) []httpRange {
+	var satisfiable []httpRange
+	for _, r := range ranges {
+		if r.start < 0 {
+			if r.end == 0 || size == 0 {
+				continue
+			}
+			r.start, r.end = max(0, size-r.end), size-1
+		}
+		if r.start >= size {
+			continue
+		}
+		if r.end < 0 || r.end >= size {
+			r.end = size - 1
+		}
+		satisfiable = append(satisfiable, r)
+	}
+	return satisfiable
+}
+
+// coalesceRanges 按起点排序并合并重叠或相邻的范围, 避免同一段数据被重复下载和返回
+func coalesceRanges(ranges []httpRange) []httpRange {
+	sorted := append([]httpRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].start < sorted[j].start
+	})
+	merged := sorted[:0]
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].end+1 {
+			merged[n-1].end = max(merged[n-1].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// parseContentRange 解析 "bytes 0-99/1000" 形式的 Content-Range 响应头, 文件大小未知时 size 为 -1
+func parseContentRange(contentRange string) (start int64, end int64, size int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(contentRange), "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rangeText, _, found := strings.Cut(spec, "/")
+	startText, endText, found2 := strings.Cut(rangeText, "-")
+	if !found || !found2 {
+		return 0, 0, 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(startText), 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	end, err = strconv.ParseInt(strings.TrimSpace(endText), 10, 64)
+	if err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	size = contentRangeSize(contentRange)
+	return start, end, size, true
+}
+
+// checkRangeResponse 检查源站是否按请求的 [start, end] 返回了数据
+// 请求整个文件时源站可以返回 200, 其余情况必须返回 206 且 Content-Range 的起止位置与请求一致
+func checkRangeResponse(statusCode int, contentRange string, start int64, end int64, size int64) error {
+	if statusCode == http.StatusOK {
+		if start == 0 && size > 0 && end == size-1 {
+			return nil
+		}
+		return fmt.Errorf("请求 bytes=%d-%d 时源站返回了 200", start, end)
+	}
+	if statusCode != http.StatusPartialContent {
+		return fmt.Errorf("请求 bytes=%d-%d 时源站返回了 %d", start, end, statusCode)
+	}
+	rangeStart, rangeEnd, _, ok := parseContentRange(contentRange)
+	if !ok || rangeStart != start || rangeEnd != end {
+		return fmt.Errorf("请求 bytes=%d-%d 时源站返回的 Content-Range 为 %q", start, end, contentRange)
+	}
+	return nil
+}
+
+// rangeUnsupportedKey 返回 mediaCache 中记录源站忽略 Range 请求的键, 按 host 记录
+func rangeUnsupportedKey(url string) string {
+	parsedURL, err := handleUrl.Parse(url)
+	if err != nil {
+		return url + "#RangeUnsupported"
+	}
+	return parsedURL.Host + "#RangeUnsupported"
+}
+
+// markRangeUnsupported 记录源站忽略 Range 请求, 之后该 host 的请求直接以单线程转发
+func markRangeUnsupported(url string) {
+	mediaCache.Set(rangeUnsupportedKey(url), true, 14400*time.Second)
+}
+
+func rangeUnsupported(url string) bool {
+	_, found := mediaCache.Get(rangeUnsupportedKey(url))
+	return found
+}
+
+// contentRangeSize 返回 Content-Range 响应头中的文件大小, 未知时返回 -1
+func contentRangeSize(contentRange string) int64 {
+	index := strings.LastIndexByte(contentRange, '/')
+	if index < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(contentRange[index+1:]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// ifRangeMatches 判断 If-Range 是否与源站的 ETag 或 Last-Modified 一致, 不一致时应忽略 Range 返回完整内容
+// ETag 按强比较, 弱 ETag 总是视为不一致
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := header.Get("ETag")
+		return strings.HasPrefix(ifRange, `"`) && strings.HasPrefix(etag, `"`) && ifRange == etag
+	}
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && lastModified.Equal(since)
+}
+
+// countingWriter 只统计写入的字节数, 用于预先计算 multipart 响应的长度
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func rangePartHeader(contentType string, r httpRange, size int64) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{"Content-Range": {r.contentRange(size)}}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return header
+}
+
+// serveMultipartRanges 以 multipart/byteranges 响应多个范围
+// ranges 需已由 coalesceRanges 合并, 各范围使用独立的下载会话, 最多 multipartParallelRanges 个范围同时下载, 按顺序写出
+func serveMultipartRanges(w http.ResponseWriter, out io.Writer, req *http.Request, url string, responseHeaders http.Header, ranges []httpRange, contentSize int64, numTasks int64, splitSize int64, maxSplitSize int64, jar *cookiejar.Jar, validator base.CacheValidator) {
+	contentType := responseHeaders.Get("Content-Type")
+	mw := multipart.NewWriter(out)
+
+	// 预先计算响应长度
+	var length countingWriter
+	counter := multipart.NewWriter(&length)
+	counter.SetBoundary(mw.Boundary())
+	for _, r := range ranges {
+		counter.CreatePart(rangePartHeader(contentType, r, contentSize))
+		length += countingWriter(r.length())
+	}
+	counter.Close()
+
+	for key, values := range responseHeaders {
+		switch strings.ToLower(key) {
+		case "connection", "proxy-connection", "transfer-encoding", "content-length", "content-range", "content-type", "accept-ranges":
+			continue
+		}
+		w.Header().Set(key, strings.Join(values, ","))
+	}
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(length), 10))
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	// 同时下载的范围平分线程数与缓冲区, 总的下载协程数与单范围请求相同
+	parallel := int64(min(len(ranges), multipartParallelRanges))
+	rangeTasks := max(1, numTasks/parallel)
+	maxChunks := max(1, int64(128*1024*1024)/splitSize/parallel)
+	sessions := make([]*ProxyDownloadStruct, len(ranges))
+	emitters := make([]*base.Emitter, len(ranges))
+	start := func(i int) {
+		r := ranges[i]
+		rp, wp := io.Pipe()
+		emitters[i] = base.NewEmitter(rp, wp)
+		sessions[i] = newProxyDownloadStruct(req.Context(), url, proxyTimeout, maxChunks, splitSize, maxSplitSize, r.start, r.end, rangeTasks, jar, runtime.NumGoroutine()+1, validator)
+		go ConcurrentDownload(sessions[i], url, r.start, r.end, splitSize, rangeTasks, emitters[i], req, jar)
+	}
+	stop := func(i int) {
+		if sessions[i] != nil {
+			sessions[i].ProxyStop()
+			emitters[i].Close()
+			sessions[i], emitters[i] = nil, nil
+		}
+	}
+	defer func() {
+		for i := range sessions {
+			stop(i)
+		}
+	}()
+	for i := 0; i < int(parallel); i++ {
+		start(i)
+	}
+
+	for i, r := range ranges {
+		if _, err := mw.CreatePart(rangePartHeader(contentType, r, contentSize)); err != nil {
+			return
+		}
+		// 按范围长度读取, 避免读到已关闭的 emitter 使 out 进入错误状态
+		n, err := io.CopyN(out, emitters[i], r.length())
+		p := sessions[i]
+		stop(i)
+		if err != nil {
+			if rangeUnsupported(url) {
+				// 下载中发现源站忽略 Range, 剩余的范围改为从同一个完整文件请求中依次转发
+				logrus.Infof("源站 %v 忽略了 Range 请求, 剩余范围改为单线程转发", url)
+				for j := i + 1; j < len(ranges); j++ {
+					stop(j)
+				}
+				if err := streamPartsIgnoringRange(p, req, mw, out, contentType, contentSize, ranges[i:], n); err != nil {
+					logrus.Errorf("单线程转发 %v 失败: %v", url, err)
+					return
+				}
+				break
+			}
+			logrus.Debugf("范围 %s 写出 %d 字节后中断: %v", r.contentRange(contentSize), n, err)
+			return
+		}
+		if next := i + int(parallel); next < len(ranges) {
+			start(next)
+		}
+	}
+	mw.Close()
+}
+
+// streamPartsIgnoringRange 以一个完整文件请求依次写出各范围, 第一个范围的分段头与前 written 字节已经写出
+func streamPartsIgnoringRange(p *ProxyDownloadStruct, req *http.Request, mw *multipart.Writer, out io.Writer, contentType string, contentSize int64, ranges []httpRange, written int64) error {
+	body, err := p.openIgnoringRange(req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	offset := int64(0)
+	for i, r := range ranges {
+		start := r.start
+		if i == 0 {
+			start += written
+		} else if _, err := mw.CreatePart(rangePartHeader(contentType, r, contentSize)); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, body, start-offset); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, body, r.end-start+1); err != nil {
+			return err
+		}
+		offset = r.end + 1
+	}
+	return nil
+}
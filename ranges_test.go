@@ -0,0 +1,404 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	handleUrl "net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"MediaProxy/base"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []httpRange
+	}{
+		{
+			name:   "单个范围",
+			header: "bytes=0-99",
+			want:   []httpRange{{0, 99}},
+		},
+		{
+			name:   "后缀范围",
+			header: "bytes=-500",
+			want:   []httpRange{{-1, 500}},
+		},
+		{
+			name:   "到文件末尾的范围",
+			header: "bytes=500-",
+			want:   []httpRange{{500, -1}},
+		},
+		{
+			name:   "多个范围",
+			header: "bytes=0-99, 500-, -500",
+			want:   []httpRange{{0, 99}, {500, -1}, {-1, 500}},
+		},
+		{
+			name:   "单位不是 bytes",
+			header: "items=0-99",
+		},
+		{
+			name:   "缺少连字符",
+			header: "bytes=100",
+		},
+		{
+			name:   "终点小于起点",
+			header: "bytes=500-100",
+		},
+		{
+			name:   "非数字",
+			header: "bytes=a-b",
+		},
+		{
+			name:   "其中一个范围无效",
+			header: "bytes=0-99, x-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRangeHeader(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRangeHeader(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSatisfiableRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []httpRange
+		size   int64
+		want   []httpRange
+	}{
+		{
+			name:   "后缀范围换算为最后的字节",
+			ranges: []httpRange{{-1, 500}},
+			size:   1000,
+			want:   []httpRange{{500, 999}},
+		},
+		{
+			name:   "后缀范围超过文件大小时返回整个文件",
+			ranges: []httpRange{{-1, 5000}},
+			size:   1000,
+			want:   []httpRange{{0, 999}},
+		},
+		{
+			name:   "到文件末尾的范围",
+			ranges: []httpRange{{500, -1}},
+			size:   1000,
+			want:   []httpRange{{500, 999}},
+		},
+		{
+			name:   "终点超过文件大小时截断",
+			ranges: []httpRange{{900, 5000}},
+			size:   1000,
+			want:   []httpRange{{900, 999}},
+		},
+		{
+			name:   "去掉无法满足的范围",
+			ranges: []httpRange{{0, 99}, {1000, 1099}, {-1, 0}},
+			size:   1000,
+			want:   []httpRange{{0, 99}},
+		},
+		{
+			name:   "起点超过文件大小",
+			ranges: []httpRange{{1000, -1}},
+			size:   1000,
+		},
+		{
+			name:   "长度为 0 的后缀范围",
+			ranges: []httpRange{{-1, 0}},
+			size:   1000,
+		},
+		{
+			name:   "空文件",
+			ranges: []httpRange{{-1, 500}, {0, -1}},
+			size:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := satisfiableRanges(tt.ranges, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("satisfiableRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 无法满足的范围返回 416, 格式无效的 Range 按未带 Range 处理, 返回完整内容
+func TestHandleMethodUnsatisfiableRange(t *testing.T) {
+	base.InitClient()
+	data := strings.Repeat("0123456789", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "unsatisfiable.bin", time.Unix(1700000000, 0), strings.NewReader(data))
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(handleMethod))
+	defer proxy.Close()
+	link := proxy.URL + "/?url=" + handleUrl.QueryEscape(upstream.URL+"/unsatisfiable.bin")
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		wantStatus   int
+		contentRange string
+	}{
+		{
+			name:         "起点超过文件大小",
+			rangeHeader:  "bytes=1000-",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */1000",
+		},
+		{
+			name:         "所有范围都无法满足",
+			rangeHeader:  "bytes=2000-2999, -0",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */1000",
+		},
+		{
+			name:        "格式无效",
+			rangeHeader: "bytes=500-100",
+			wantStatus:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodGet, link, nil)
+			request.Header.Set("Range", tt.rangeHeader)
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus || resp.Header.Get("Content-Range") != tt.contentRange {
+				t.Errorf("Range: %s 返回 statusCode %d, Content-Range %q, want %d, %q", tt.rangeHeader, resp.StatusCode, resp.Header.Get("Content-Range"), tt.wantStatus, tt.contentRange)
+			}
+		})
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	header := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Tue, 14 Nov 2023 22:13:20 GMT"},
+	}
+	weakHeader := http.Header{"Etag": {`W/"v1"`}}
+	tests := []struct {
+		name    string
+		ifRange string
+		header  http.Header
+		want    bool
+	}{
+		{
+			name:   "未带 If-Range",
+			header: header,
+			want:   true,
+		},
+		{
+			name:    "强 ETag 一致",
+			ifRange: `"v1"`,
+			header:  header,
+			want:    true,
+		},
+		{
+			name:    "强 ETag 不一致",
+			ifRange: `"v2"`,
+			header:  header,
+		},
+		{
+			name:    "弱 ETag 总是不一致",
+			ifRange: `W/"v1"`,
+			header:  weakHeader,
+		},
+		{
+			name:    "源站返回弱 ETag",
+			ifRange: `"v1"`,
+			header:  weakHeader,
+		},
+		{
+			name:    "日期与 Last-Modified 一致",
+			ifRange: "Tue, 14 Nov 2023 22:13:20 GMT",
+			header:  header,
+			want:    true,
+		},
+		{
+			name:    "日期与 Last-Modified 不一致",
+			ifRange: "Tue, 14 Nov 2023 22:13:21 GMT",
+			header:  header,
+		},
+		{
+			name:    "源站没有 Last-Modified",
+			ifRange: "Tue, 14 Nov 2023 22:13:20 GMT",
+			header:  weakHeader,
+		},
+		{
+			name:    "无效的日期",
+			ifRange: "yesterday",
+			header:  header,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ifRangeMatches(tt.ifRange, tt.header); got != tt.want {
+				t.Errorf("ifRangeMatches(%q) = %v, want %v", tt.ifRange, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []httpRange
+		want   []httpRange
+	}{
+		{
+			name:   "重复的范围",
+			ranges: []httpRange{{0, 999}, {0, 999}, {0, 999}},
+			want:   []httpRange{{0, 999}},
+		},
+		{
+			name:   "重叠与相邻的范围",
+			ranges: []httpRange{{500, 599}, {100, 199}, {150, 299}, {300, 399}},
+			want:   []httpRange{{100, 399}, {500, 599}},
+		},
+		{
+			name:   "互不相邻的范围按起点排序",
+			ranges: []httpRange{{1000, 1099}, {0, 9}},
+			want:   []httpRange{{0, 9}, {1000, 1099}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coalesceRanges(tt.ranges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("coalesceRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRangeResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCode   int
+		contentRange string
+		start        int64
+		end          int64
+		size         int64
+		wantErr      bool
+	}{
+		{
+			name:         "206 与请求一致",
+			statusCode:   http.StatusPartialContent,
+			contentRange: "bytes 1024-2047/10000",
+			start:        1024,
+			end:          2047,
+			size:         10000,
+		},
+		{
+			name:         "206 的起点不一致",
+			statusCode:   http.StatusPartialContent,
+			contentRange: "bytes 0-2047/10000",
+			start:        1024,
+			end:          2047,
+			size:         10000,
+			wantErr:      true,
+		},
+		{
+			name:         "206 的终点不一致",
+			statusCode:   http.StatusPartialContent,
+			contentRange: "bytes 1024-4095/10000",
+			start:        1024,
+			end:          2047,
+			size:         10000,
+			wantErr:      true,
+		},
+		{
+			// 文件大小由 checkValidator 检查, 此处只检查起止位置
+			name:         "206 的文件大小不一致",
+			statusCode:   http.StatusPartialContent,
+			contentRange: "bytes 1024-2047/20000",
+			start:        1024,
+			end:          2047,
+			size:         10000,
+		},
+		{
+			name:         "206 的文件大小未知",
+			statusCode:   http.StatusPartialContent,
+			contentRange: "bytes 1024-2047/*",
+			start:        1024,
+			end:          2047,
+			size:         10000,
+		},
+		{
+			name:       "206 缺少 Content-Range",
+			statusCode: http.StatusPartialContent,
+			start:      1024,
+			end:        2047,
+			size:       10000,
+			wantErr:    true,
+		},
+		{
+			name:         "206 的 Content-Range 无效",
+			statusCode:   http.StatusPartialContent,
+			contentRange: "bytes */10000",
+			start:        1024,
+			end:          2047,
+			size:         10000,
+			wantErr:      true,
+		},
+		{
+			name:       "请求部分内容时返回 200",
+			statusCode: http.StatusOK,
+			start:      1024,
+			end:        2047,
+			size:       10000,
+			wantErr:    true,
+		},
+		{
+			name:       "请求整个文件时返回 200",
+			statusCode: http.StatusOK,
+			start:      0,
+			end:        9999,
+			size:       10000,
+		},
+		{
+			name:       "文件大小未知时返回 200",
+			statusCode: http.StatusOK,
+			start:      0,
+			end:        9999,
+			size:       -1,
+			wantErr:    true,
+		},
+		{
+			name:       "其他状态码",
+			statusCode: http.StatusForbidden,
+			start:      1024,
+			end:        2047,
+			size:       10000,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRangeResponse(tt.statusCode, tt.contentRange, tt.start, tt.end, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkRangeResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// 206 的文件大小与会话开始时不一致时由 checkValidator 中止会话
+	p := &ProxyDownloadStruct{Validator: base.CacheValidator{Size: 10000}}
+	if err := p.checkValidator(http.Header{"Content-Range": {"bytes 1024-2047/20000"}}); err == nil {
+		t.Error("checkValidator() 未发现文件大小的变化")
+	}
+	if err := p.checkValidator(http.Header{"Content-Range": {"bytes 1024-2047/*"}}); err != nil {
+		t.Errorf("checkValidator() 文件大小未知时 error = %v", err)
+	}
+}